@@ -0,0 +1,230 @@
+package sharding
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/longbridgeapp/sqlparser"
+)
+
+// aggregate is an aggregate column in the result, combined from the partial
+// results of the sharding tables.
+type aggregate struct {
+	fn    string // count, sum, min, max or avg
+	index int    // column index in the result
+
+	// count is the column index of the hidden COUNT for avg,
+	// avg is rewritten as SUM and COUNT and divided after merge.
+	count int
+}
+
+// planAggregates finds the aggregate functions in the select list.
+func planAggregates(stmt *sqlparser.SelectStatement, plan *mergePlan) error {
+	for i, col := range *stmt.Columns {
+		if col.Star {
+			continue
+		}
+
+		call, ok := col.Expr.(*sqlparser.Call)
+		if !ok || !isAggregate(call) {
+			if containsAggregate(col.Expr) {
+				return fmt.Errorf("aggregate expression %s over multiple sharding tables is not supported", col.Expr.String())
+			}
+			continue
+		}
+
+		if err := plan.planAggregate(stmt, col, i); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// planAggregate plans the aggregate column at index of the select list,
+// AVG is rewritten to SUM with an extra COUNT column.
+func (p *mergePlan) planAggregate(stmt *sqlparser.SelectStatement, col *sqlparser.ResultColumn, index int) error {
+	call := col.Expr.(*sqlparser.Call)
+	if hasStar, _ := outputNames(stmt.Columns); hasStar {
+		return fmt.Errorf("%s with * over multiple sharding tables is not supported", call.String())
+	}
+
+	agg := aggregate{fn: strings.ToLower(call.Name.Name), index: index}
+	if call.Distinct && agg.fn != "min" && agg.fn != "max" {
+		return fmt.Errorf("%s over multiple sharding tables is not supported", call.String())
+	}
+
+	if agg.fn == "avg" {
+		if col.Alias == nil {
+			col.Alias = &sqlparser.Ident{Name: agg.fn}
+		}
+		col.Expr = &sqlparser.Call{Name: &sqlparser.Ident{Name: "sum"}, Args: call.Args, Filter: call.Filter}
+
+		agg.count = len(*stmt.Columns)
+		*stmt.Columns = append(*stmt.Columns, &sqlparser.ResultColumn{
+			Expr:  &sqlparser.Call{Name: &sqlparser.Ident{Name: "count"}, Args: call.Args, Filter: call.Filter},
+			Alias: &sqlparser.Ident{Name: fmt.Sprintf("sharding_avg_count_%d", index+1)},
+		})
+		p.hidden++
+	}
+	p.aggregates = append(p.aggregates, agg)
+
+	return nil
+}
+
+func isAggregate(call *sqlparser.Call) bool {
+	switch strings.ToLower(call.Name.Name) {
+	case "count", "sum", "min", "max", "avg":
+		return true
+	}
+	return false
+}
+
+func containsAggregate(expr sqlparser.Expr) (found bool) {
+	sqlparser.Walk(sqlparser.VisitFunc(func(node sqlparser.Node) error {
+		if call, ok := node.(*sqlparser.Call); ok && isAggregate(call) {
+			found = true
+		}
+		return nil
+	}), expr)
+	return
+}
+
+// combine combines the partial aggregate rows into one row,
+// the other columns take the values of the first row.
+func (p *mergePlan) combine(rows [][]driver.Value, set *rowSet) ([]driver.Value, error) {
+	row := make([]driver.Value, len(rows[0]))
+	copy(row, rows[0])
+
+	for _, agg := range p.aggregates {
+		var value driver.Value
+		var err error
+		switch agg.fn {
+		case "count", "sum":
+			for _, r := range rows {
+				if value, err = addValue(value, r[agg.index]); err != nil {
+					return nil, err
+				}
+			}
+			if value == nil && agg.fn == "count" {
+				value = int64(0)
+			}
+		case "min", "max":
+			numeric := set.isNumeric(agg.index)
+			for _, r := range rows {
+				v := r[agg.index]
+				if v == nil {
+					continue
+				}
+				if value == nil {
+					value = v
+					continue
+				}
+				c := compareValue(v, value, numeric)
+				if (agg.fn == "min" && c < 0) || (agg.fn == "max" && c > 0) {
+					value = v
+				}
+			}
+		case "avg":
+			var count driver.Value
+			for _, r := range rows {
+				if value, err = addValue(value, r[agg.index]); err != nil {
+					return nil, err
+				}
+				if count, err = addValue(count, r[agg.count]); err != nil {
+					return nil, err
+				}
+			}
+			if value, err = divideValue(value, count); err != nil {
+				return nil, err
+			}
+		}
+		row[agg.index] = value
+	}
+
+	return row, nil
+}
+
+// avgScale is the scale of the AVG results, same as PostgreSQL for integers.
+const avgScale = 16
+
+// addValue adds two partial results, NULL is ignored.
+func addValue(x, y driver.Value) (driver.Value, error) {
+	if x == nil {
+		return y, nil
+	} else if y == nil {
+		return x, nil
+	}
+
+	switch x := x.(type) {
+	case int64:
+		switch y := y.(type) {
+		case int64:
+			return x + y, nil
+		case float64:
+			return float64(x) + y, nil
+		}
+	case float64:
+		switch y := y.(type) {
+		case float64:
+			return x + y, nil
+		case int64:
+			return x + float64(y), nil
+		}
+	}
+
+	a, ok := parseNumber(x)
+	if !ok {
+		return nil, fmt.Errorf("invalid number %v", x)
+	}
+	b, ok := parseNumber(y)
+	if !ok {
+		return nil, fmt.Errorf("invalid number %v", y)
+	}
+
+	scale := numberScale(x)
+	if s := numberScale(y); s > scale {
+		scale = s
+	}
+	return new(big.Rat).Add(a, b).FloatString(scale), nil
+}
+
+// divideValue divides the sum by the count, returns NULL when count is zero.
+func divideValue(sum, count driver.Value) (driver.Value, error) {
+	if sum == nil || count == nil {
+		return nil, nil
+	}
+
+	n, ok := parseNumber(count)
+	if !ok {
+		return nil, fmt.Errorf("invalid number %v", count)
+	}
+	if n.Sign() == 0 {
+		return nil, nil
+	}
+
+	if sum, ok := sum.(float64); ok {
+		f, _ := n.Float64()
+		return sum / f, nil
+	}
+
+	s, ok := parseNumber(sum)
+	if !ok {
+		return nil, fmt.Errorf("invalid number %v", sum)
+	}
+	return new(big.Rat).Quo(s, n).FloatString(avgScale), nil
+}
+
+// numberScale returns the number of digits after the decimal point.
+func numberScale(v driver.Value) int {
+	switch v.(type) {
+	case string, []byte:
+		s := string(valueBytes(v))
+		if i := strings.IndexByte(s, '.'); i >= 0 {
+			return len(strings.TrimSpace(s[i+1:]))
+		}
+	}
+	return 0
+}
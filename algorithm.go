@@ -0,0 +1,350 @@
+package sharding
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/longbridgeapp/gorm-sharding/keygen"
+)
+
+// Algorithm is a built-in sharding algorithm on a single sharding column, created by
+// Modulo, Hash, ConsistentHash, Ranges or Calendar. It is a ShardRouter and a
+// PrimaryKeyRouter, and its methods are used as the other fields of Resolver.
+//
+//	algorithm := sharding.Modulo(4)
+//	sharding.Resolver{
+//		ShardingColumn:           "user_id",
+//		ShardRouter:              algorithm,
+//		ShardingAlgorithmByRange: algorithm.Range,
+//		ShardingSuffixes:         algorithm.Suffixes,
+//	}
+type Algorithm struct {
+	count  int
+	index  func(value interface{}) (int64, error)
+	suffix func(index int64) string
+
+	// position returns the index of the sharding table a value falls in, or an index
+	// out of the tables. It is only set when the tables are ordered by the values.
+	position func(value interface{}) (int64, error)
+
+	// calendar means the tables are periods of time.
+	calendar bool
+}
+
+// Count returns the number of the sharding tables.
+func (a *Algorithm) Count() int {
+	return a.count
+}
+
+// Suffix returns the suffix of the sharding table of value, it can be used as ShardingAlgorithm.
+func (a *Algorithm) Suffix(value interface{}) (suffix string, err error) {
+	index, err := a.index(value)
+	if err != nil {
+		return "", err
+	}
+	return a.suffix(index), nil
+}
+
+// Target returns the sharding table of the value of the sharding column,
+// as a ShardRouter.
+func (a *Algorithm) Target(values []interface{}) (target ShardTarget, err error) {
+	index, err := a.index(values[0])
+	if err != nil {
+		return ShardTarget{}, err
+	}
+	return ShardTarget{Index: index, Suffix: a.suffix(index)}, nil
+}
+
+// PrimaryKeySuffix returns the suffix of the sharding table of a keygen id, as a
+// PrimaryKeyRouter. The table is found by the table index in
+// the id, or for Calendar, by the time the id is generated, which is the table of the
+// rows with the sharding key at the time of insert, such as `created_at`.
+func (a *Algorithm) PrimaryKeySuffix(value interface{}) (suffix string, err error) {
+	id, err := toInt64(value)
+	if err != nil {
+		return "", ErrInvalidID
+	}
+	if a.calendar {
+		return a.Suffix(keygen.Time(id))
+	}
+
+	index := int64(keygen.TableIdx(id))
+	if index >= int64(a.count) {
+		return "", ErrInvalidID
+	}
+	return a.suffix(index), nil
+}
+
+// Suffixes returns the suffixes of all the sharding tables, it can be used as ShardingSuffixes.
+func (a *Algorithm) Suffixes() (suffixes []string) {
+	for i := 0; i < a.count; i++ {
+		suffixes = append(suffixes, a.suffix(int64(i)))
+	}
+	return
+}
+
+// Range returns the suffixes of the sharding tables covering the values between
+// begin and end, it can be used as ShardingAlgorithmByRange. ErrUnorderedRange is
+// returned when the tables are not ordered by the values, such as by Modulo or Hash.
+func (a *Algorithm) Range(begin, end interface{}) (suffixes []string, err error) {
+	if a.position == nil {
+		return nil, ErrUnorderedRange
+	}
+
+	first, last := int64(0), int64(a.count-1)
+	if begin != nil {
+		index, err := a.position(begin)
+		if err != nil {
+			return nil, err
+		}
+		if index > first {
+			first = index
+		}
+	}
+	if end != nil {
+		index, err := a.position(end)
+		if err != nil {
+			return nil, err
+		}
+		if index < last {
+			last = index
+		}
+	}
+
+	suffixes = []string{}
+	for i := first; i <= last; i++ {
+		suffixes = append(suffixes, a.suffix(i))
+	}
+	return suffixes, nil
+}
+
+// Modulo creates an algorithm which shards an integer key into count tables by the
+// remainder of the key, suffixed `_00`, `_01` and so on. Integers of any type,
+// numeric strings and driver.Valuer are accepted as the key.
+func Modulo(count int) *Algorithm {
+	if count <= 0 {
+		panic("sharding: count of the sharding tables must be positive")
+	}
+
+	return &Algorithm{
+		count: count,
+		index: func(value interface{}) (int64, error) {
+			n, err := toInt64(value)
+			if err != nil {
+				return 0, err
+			}
+			index := n % int64(count)
+			if index < 0 {
+				index += int64(count)
+			}
+			return index, nil
+		},
+		suffix: indexSuffix(count),
+	}
+}
+
+// Hash creates an algorithm which shards a key into count tables by its hash, such
+// as CRC32, XXHash or Murmur3, suffixed `_00`, `_01` and so on. Strings, bytes,
+// integers, time.Time, driver.Valuer and fmt.Stringer are accepted as the key.
+// count must not exceed 512, the table indexes keygen can encode.
+func Hash(count int, hash func(b []byte) uint64) *Algorithm {
+	if count <= 0 {
+		panic("sharding: count of the sharding tables must be positive")
+	}
+	if count > maxTableIndex+1 {
+		panic("sharding: count of the sharding tables must not exceed 512")
+	}
+
+	return &Algorithm{
+		count: count,
+		index: func(value interface{}) (int64, error) {
+			b, err := toBytes(value)
+			if err != nil {
+				return 0, err
+			}
+			return int64(hash(b) % uint64(count)), nil
+		},
+		suffix: indexSuffix(count),
+	}
+}
+
+// ConsistentHash creates an algorithm which shards a key into count tables on a hash
+// ring, each table has replicas virtual nodes on it. Adding a table only moves the
+// keys of its virtual nodes. The keys and count are accepted as Hash does.
+func ConsistentHash(count, replicas int, hash func(b []byte) uint64) *Algorithm {
+	if count <= 0 || replicas <= 0 {
+		panic("sharding: count of the sharding tables and replicas must be positive")
+	}
+	if count > maxTableIndex+1 {
+		panic("sharding: count of the sharding tables must not exceed 512")
+	}
+
+	type node struct {
+		hash  uint64
+		index int64
+	}
+	ring := make([]node, 0, count*replicas)
+	for i := 0; i < count; i++ {
+		for j := 0; j < replicas; j++ {
+			ring = append(ring, node{hash: hash([]byte(fmt.Sprintf("%d#%d", i, j))), index: int64(i)})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool {
+		return ring[i].hash < ring[j].hash
+	})
+
+	return &Algorithm{
+		count: count,
+		index: func(value interface{}) (int64, error) {
+			b, err := toBytes(value)
+			if err != nil {
+				return 0, err
+			}
+			h := hash(b)
+			i := sort.Search(len(ring), func(i int) bool {
+				return ring[i].hash >= h
+			})
+			if i == len(ring) {
+				i = 0
+			}
+			return ring[i].index, nil
+		},
+		suffix: indexSuffix(count),
+	}
+}
+
+// Ranges creates an algorithm which shards an integer key by the fixed ranges split at
+// bounds, in ascending order. The table `_00` holds the keys less than bounds[0], the
+// table `_01` holds the keys from bounds[0] to bounds[1] exclusive, and the last table
+// holds the keys from the last bound on. The keys are accepted as Modulo does.
+func Ranges(bounds ...int64) *Algorithm {
+	if !sort.SliceIsSorted(bounds, func(i, j int) bool { return bounds[i] < bounds[j] }) {
+		panic("sharding: bounds of the ranges must be in ascending order")
+	}
+
+	position := func(value interface{}) (int64, error) {
+		n, err := toInt64(value)
+		if err != nil {
+			return 0, err
+		}
+		return int64(sort.Search(len(bounds), func(i int) bool {
+			return bounds[i] > n
+		})), nil
+	}
+
+	return &Algorithm{
+		count:    len(bounds) + 1,
+		index:    position,
+		suffix:   indexSuffix(len(bounds) + 1),
+		position: position,
+	}
+}
+
+// CalendarUnit is the period of the sharding tables of Calendar.
+type CalendarUnit int
+
+const (
+	// ByDay shards by day, suffixed like `_20260102`.
+	ByDay CalendarUnit = iota
+	// ByMonth shards by month, suffixed like `_202601`.
+	ByMonth
+	// ByYear shards by year, suffixed like `_2026`.
+	ByYear
+)
+
+// Calendar creates an algorithm which shards a time key by day, month or year in UTC,
+// with the tables of the periods from begin to end. The index of a table is its
+// period since begin. time.Time, strings in RFC 3339 or like "2006-01-02" and
+// driver.Valuer are accepted as the key. A key out of the tables is an error.
+func Calendar(unit CalendarUnit, begin, end time.Time) *Algorithm {
+	var layout string
+	switch unit {
+	case ByDay:
+		layout = "_20060102"
+	case ByMonth:
+		layout = "_200601"
+	case ByYear:
+		layout = "_2006"
+	default:
+		panic("sharding: invalid calendar unit")
+	}
+
+	start := truncateTime(begin, unit)
+	periods := func(t time.Time) int64 {
+		t = truncateTime(t, unit)
+		switch unit {
+		case ByDay:
+			return int64(t.Sub(start) / (24 * time.Hour))
+		case ByMonth:
+			return int64(t.Year()-start.Year())*12 + int64(t.Month()-start.Month())
+		default:
+			return int64(t.Year() - start.Year())
+		}
+	}
+	count := int(periods(end)) + 1
+	if count <= 0 {
+		panic("sharding: end of the calendar must not be before begin")
+	}
+
+	position := func(value interface{}) (int64, error) {
+		t, err := toTime(value)
+		if err != nil {
+			return 0, err
+		}
+		return periods(t), nil
+	}
+
+	a := &Algorithm{
+		count:    count,
+		position: position,
+		calendar: true,
+		suffix: func(index int64) string {
+			switch unit {
+			case ByDay:
+				return start.AddDate(0, 0, int(index)).Format(layout)
+			case ByMonth:
+				return start.AddDate(0, int(index), 0).Format(layout)
+			default:
+				return start.AddDate(int(index), 0, 0).Format(layout)
+			}
+		},
+	}
+	a.index = func(value interface{}) (int64, error) {
+		index, err := position(value)
+		if err != nil {
+			return 0, err
+		}
+		if index < 0 || index >= int64(count) {
+			return 0, fmt.Errorf("%v is out of the sharding tables from %s to %s", value, a.suffix(0), a.suffix(int64(count-1)))
+		}
+		return index, nil
+	}
+	return a
+}
+
+// truncateTime returns the beginning of the period of t in UTC.
+func truncateTime(t time.Time, unit CalendarUnit) time.Time {
+	t = t.UTC()
+	switch unit {
+	case ByDay:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	case ByMonth:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	default:
+		return time.Date(t.Year(), 1, 1, 0, 0, 0, 0, time.UTC)
+	}
+}
+
+// indexSuffix returns the suffix of a table index, `_00`, `_01` and so on,
+// with more digits for more than 100 tables.
+func indexSuffix(count int) func(index int64) string {
+	width := len(strconv.Itoa(count - 1))
+	if width < 2 {
+		width = 2
+	}
+	return func(index int64) string {
+		return fmt.Sprintf("_%0*d", width, index)
+	}
+}
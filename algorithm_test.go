@@ -0,0 +1,139 @@
+package sharding
+
+import (
+	"testing"
+	"time"
+
+	"github.com/longbridgeapp/assert"
+	"github.com/longbridgeapp/gorm-sharding/keygen"
+)
+
+func TestHash(t *testing.T) {
+	assert.Equal(t, uint64(0x3610a686), CRC32([]byte("hello")))
+	assert.Equal(t, uint64(0), Murmur3(nil))
+	assert.Equal(t, uint64(0x2e4ff723), Murmur3([]byte("The quick brown fox jumps over the lazy dog")))
+	assert.Equal(t, uint64(0xef46db3751d8e999), XXHash(nil))
+	assert.Equal(t, uint64(0x44bc2cf5ad770999), XXHash([]byte("abc")))
+	assert.Equal(t, uint64(0xfbcea83c8a378bf1), XXHash([]byte("Nobody inspects the spammish repetition")))
+}
+
+func TestModulo(t *testing.T) {
+	algorithm := Modulo(4)
+	assert.Equal(t, 4, algorithm.Count())
+	assert.Equal(t, []string{"_00", "_01", "_02", "_03"}, algorithm.Suffixes())
+
+	for _, value := range []interface{}{5, int32(5), uint64(5), "5", []byte("5"), int64(-3)} {
+		suffix, err := algorithm.Suffix(value)
+		assert.Nil(t, err)
+		assert.Equal(t, "_01", suffix)
+	}
+
+	_, err := algorithm.Suffix("abc")
+	assert.Equal(t, `invalid integer sharding key "abc"`, err.Error())
+
+	target, err := Modulo(128).Target([]interface{}{int64(300)})
+	assert.Nil(t, err)
+	assert.Equal(t, ShardTarget{Index: 44, Suffix: "_044"}, target)
+}
+
+func TestHashAlgorithm(t *testing.T) {
+	algorithm := Hash(8, CRC32)
+	suffix, err := algorithm.Suffix("hello")
+	assert.Nil(t, err)
+	assert.Equal(t, "_06", suffix) // 0x3610a686 % 8
+
+	suffix, err = Modulo(4).PrimaryKeySuffix(keygen.Next(3))
+	assert.Nil(t, err)
+	assert.Equal(t, "_03", suffix)
+
+	_, err = algorithm.Range("a", "b")
+	assert.Equal(t, ErrUnorderedRange, err)
+
+	created := time.Date(2026, 10, 1, 8, 0, 0, 0, time.FixedZone("UTC+8", 8*3600))
+	suffix, err = algorithm.Suffix(created)
+	assert.Nil(t, err)
+	for _, value := range []interface{}{created.UTC(), created.In(time.Local)} {
+		s, err := algorithm.Suffix(value)
+		assert.Nil(t, err)
+		assert.Equal(t, suffix, s)
+	}
+	now := time.Now()
+	a, _ := algorithm.Suffix(now)
+	b, _ := algorithm.Suffix(now.Round(0))
+	assert.Equal(t, a, b)
+
+	assert.Equal(t, "sharding: count of the sharding tables must not exceed 512", panicValue(func() { Hash(513, CRC32) }))
+	assert.Equal(t, "sharding: count of the sharding tables must not exceed 512", panicValue(func() { ConsistentHash(513, 1, CRC32) }))
+	assert.Equal(t, nil, panicValue(func() { Hash(512, CRC32) }))
+}
+
+func panicValue(fn func()) (value interface{}) {
+	defer func() {
+		value = recover()
+	}()
+	fn()
+	return nil
+}
+
+func TestConsistentHash(t *testing.T) {
+	small, large := ConsistentHash(4, 64, XXHash), ConsistentHash(5, 64, XXHash)
+
+	moved := 0
+	for i := 0; i < 1000; i++ {
+		a, err := small.Target([]interface{}{i})
+		assert.Nil(t, err)
+		b, err := large.Target([]interface{}{i})
+		assert.Nil(t, err)
+		if a != b {
+			moved++
+			assert.Equal(t, int64(4), b.Index)
+		}
+	}
+	assert.Equal(t, true, moved > 0 && moved < 400)
+}
+
+func TestRanges(t *testing.T) {
+	algorithm := Ranges(100, 200)
+	assert.Equal(t, 3, algorithm.Count())
+
+	for value, suffix := range map[int64]string{-1: "_00", 99: "_00", 100: "_01", 199: "_01", 200: "_02", 1000: "_02"} {
+		s, err := algorithm.Suffix(value)
+		assert.Nil(t, err)
+		assert.Equal(t, suffix, s)
+	}
+
+	suffixes, err := algorithm.Range(150, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"_01", "_02"}, suffixes)
+}
+
+func TestCalendar(t *testing.T) {
+	begin := time.Date(2025, 11, 15, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC)
+
+	months := Calendar(ByMonth, begin, end)
+	assert.Equal(t, []string{"_202511", "_202512", "_202601", "_202602"}, months.Suffixes())
+
+	target, err := months.Target([]interface{}{"2026-01-20"})
+	assert.Nil(t, err)
+	assert.Equal(t, ShardTarget{Index: 2, Suffix: "_202601"}, target)
+
+	_, err = months.Suffix(time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC))
+	assert.Equal(t, "2026-03-01 00:00:00 +0000 UTC is out of the sharding tables from _202511 to _202602", err.Error())
+
+	suffixes, err := months.Range(time.Date(2025, 12, 31, 0, 0, 0, 0, time.UTC), time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"_202512", "_202601"}, suffixes)
+
+	suffixes, err = months.Range(time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{}, suffixes)
+
+	id := keygen.Next(0)
+	suffix, err := Calendar(ByDay, keygen.Time(id).AddDate(0, 0, -1), keygen.Time(id)).PrimaryKeySuffix(id)
+	assert.Nil(t, err)
+	assert.Equal(t, keygen.Time(id).Format("_20060102"), suffix)
+
+	assert.Equal(t, 79, Calendar(ByDay, begin, end).Count())
+	assert.Equal(t, []string{"_2025", "_2026"}, Calendar(ByYear, begin, end).Suffixes())
+}
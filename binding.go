@@ -0,0 +1,143 @@
+package sharding
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/longbridgeapp/sqlparser"
+)
+
+// sourceTables returns the tables of a FROM clause,
+// the tables of the subqueries in it are not included.
+func sourceTables(source sqlparser.Source) []*sqlparser.TableName {
+	switch x := source.(type) {
+	case *sqlparser.TableName:
+		return []*sqlparser.TableName{x}
+	case *sqlparser.JoinClause:
+		return append(sourceTables(x.X), sourceTables(x.Y)...)
+	}
+	return nil
+}
+
+// bindingTables returns the sharding tables among tables, the first one decides the
+// sharding tables to run on. Broadcast tables are not sharding tables.
+// An *UnsupportedQueryError wrapping ErrUnboundTables is returned when they are not
+// in the same binding group.
+func (s *Sharding) bindingTables(tables []*sqlparser.TableName) ([]*sqlparser.TableName, error) {
+	var sharded []*sqlparser.TableName
+	var names []string
+	bound := true
+	for _, table := range tables {
+		r, ok := s.resolver(table.Name.Name)
+		if !ok || r.Broadcast {
+			continue
+		}
+		if len(sharded) > 0 {
+			first, _ := s.resolver(sharded[0].Name.Name)
+			bound = bound && first.BindingGroup != "" && r.BindingGroup == first.BindingGroup
+		}
+		sharded = append(sharded, table)
+		names = append(names, table.Name.Name)
+	}
+	if !bound {
+		return nil, &UnsupportedQueryError{
+			Table: names[0],
+			Err:   fmt.Errorf("%w: %s", ErrUnboundTables, strings.Join(names, ", ")),
+		}
+	}
+	return sharded, nil
+}
+
+// bound reports whether table and the first table of tables are in the same binding group.
+func (s *Sharding) bound(table *sqlparser.TableName, tables []*sqlparser.TableName) bool {
+	if len(tables) == 0 {
+		return false
+	}
+	r, _ := s.resolver(table.Name.Name)
+	first, _ := s.resolver(tables[0].Name.Name)
+	return r.BindingGroup != "" && r.BindingGroup == first.BindingGroup
+}
+
+// broadcast copies a write to a broadcast table to all the databases.
+func (s *Sharding) broadcast(query shardQuery) []shardQuery {
+	var names []string
+	for name := range s.Databases {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	queries := []shardQuery{query}
+	for _, name := range names {
+		queries = append(queries, shardQuery{query: query.query, args: query.args, database: name, copy: true})
+	}
+	return queries
+}
+
+// tableRename renames a sharding table in the statement to its sharding table,
+// with the columns qualified by the table name.
+type tableRename struct {
+	table *sqlparser.TableName
+	name  string
+	refs  []*sqlparser.QualifiedRef
+}
+
+func newTableRenames(stmt sqlparser.Statement, tables []*sqlparser.TableName) []*tableRename {
+	renames := make([]*tableRename, len(tables))
+	qualified := make(map[string]*tableRename)
+	for i, table := range tables {
+		renames[i] = &tableRename{table: table, name: table.Name.Name}
+		if table.Alias == nil {
+			qualified[refName(table)] = renames[i]
+		}
+	}
+
+	walkStatement(stmt, func(node sqlparser.Node) {
+		if ref, ok := node.(*sqlparser.QualifiedRef); ok {
+			if rename, ok := qualified[sqlparser.IdentName(ref.Table)]; ok {
+				rename.refs = append(rename.refs, ref)
+			}
+		}
+	})
+
+	return renames
+}
+
+// apply renames the table to the sharding table with suffix, the schema of the table is kept.
+func (r *tableRename) apply(suffix string) {
+	r.table.Name = &sqlparser.Ident{Name: r.name + suffix}
+	_, name := splitSchema(r.name)
+	for _, ref := range r.refs {
+		ref.Table = &sqlparser.Ident{Name: name + suffix}
+	}
+}
+
+// walkStatement calls fn for each node of stmt, including the result columns
+// of the select statements and the RETURNING columns, which are skipped by sqlparser.Walk.
+func walkStatement(stmt sqlparser.Statement, fn func(node sqlparser.Node)) {
+	var visit sqlparser.VisitFunc
+	visit = func(node sqlparser.Node) error {
+		fn(node)
+
+		var columns *sqlparser.OutputNames
+		switch x := node.(type) {
+		case *sqlparser.SelectStatement:
+			columns = x.Columns
+		case *sqlparser.InsertStatement:
+			columns = x.OutputExpressions
+		case *sqlparser.UpdateStatement:
+			columns = x.OutputExpressions
+		case *sqlparser.DeleteStatement:
+			columns = x.OutputExpressions
+		}
+		if columns != nil {
+			for _, col := range *columns {
+				sqlparser.Walk(visit, col)
+			}
+		}
+		return nil
+	}
+	sqlparser.Walk(visit, stmt)
+}
@@ -0,0 +1,48 @@
+package sharding
+
+import (
+	"context"
+
+	"gorm.io/gorm"
+)
+
+const scatterGatherKey = "sharding:scatter_gather"
+
+type scatterGatherContextKey struct{}
+
+// ScatterGather is a Gorm scope allows a query without sharding key
+// to run on all the sharding tables, the rows are merged for the caller.
+//
+//	db.Scopes(sharding.ScatterGather).Where("product", "iPad").Find(&orders)
+func ScatterGather(db *gorm.DB) *gorm.DB {
+	return db.Set(scatterGatherKey, true)
+}
+
+// registerCallbacks pass the per query options to ConnPool by the statement context.
+func (s *Sharding) registerCallbacks(db *gorm.DB) error {
+	err := db.Callback().Query().Before("gorm:query").Register("gorm:sharding:scatter_gather", scatterGather)
+	if err != nil {
+		return err
+	}
+	err = db.Callback().Row().Before("gorm:row").Register("gorm:sharding:scatter_gather", scatterGather)
+	if err != nil {
+		return err
+	}
+	err = db.Callback().Query().Before("gorm:query").Register("gorm:sharding:primary", primary)
+	if err != nil {
+		return err
+	}
+	return db.Callback().Row().Before("gorm:row").Register("gorm:sharding:primary", primary)
+}
+
+func scatterGather(db *gorm.DB) {
+	if enabled, ok := db.Get(scatterGatherKey); ok && enabled == true {
+		db.Statement.Context = context.WithValue(db.Statement.Context, scatterGatherContextKey{}, true)
+	}
+}
+
+// isScatterGather reports whether the query in ctx is allowed to run on all the sharding tables.
+func isScatterGather(ctx context.Context) bool {
+	enabled, _ := ctx.Value(scatterGatherContextKey{}).(bool)
+	return enabled
+}
@@ -3,6 +3,8 @@ package sharding
 import (
 	"context"
 	"database/sql"
+	"database/sql/driver"
+	"fmt"
 
 	"gorm.io/gorm"
 )
@@ -12,6 +14,9 @@ type ConnPool struct {
 	// db, This is global db instance
 	sharding *Sharding
 	gorm.ConnPool
+
+	// tx is the transaction of a TxConnPool.
+	tx *transaction
 }
 
 // registerConnPool replace Gorm db.ConnPool as custom
@@ -31,83 +36,255 @@ func (pool *ConnPool) String() string {
 	return "gorm:sharding:conn_pool"
 }
 
+func (pool *ConnPool) Ping() error {
+	return nil
+}
+
 func (pool ConnPool) PrepareContext(ctx context.Context, query string) (*sql.Stmt, error) {
 	return pool.ConnPool.PrepareContext(ctx, query)
 }
 
 func (pool ConnPool) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
-	ftQuery, stQuery, table, err := pool.sharding.resolve(query, args...)
+	ftQuery, stQueries, _, table, err := pool.sharding.resolve(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
 
-	pool.sharding.querys.Store("last_query", stQuery)
+	pool.sharding.storeLastQuery(stQueries)
+	if err := pool.pin(table, stQueries); err != nil {
+		return nil, err
+	}
 
 	if table != "" {
-		if r, ok := pool.sharding.Resolvers[table]; ok {
+		if r, ok := pool.sharding.resolver(table); ok {
 			if r.EnableFullTable {
 				pool.ConnPool.ExecContext(ctx, ftQuery, args...)
 			}
 		}
 	}
 
-	return pool.ConnPool.ExecContext(ctx, stQuery, args...)
+	if len(stQueries) == 1 {
+		conn, err := pool.connPool(stQueries[0].database, false)
+		if err != nil {
+			return nil, err
+		}
+		return conn.ExecContext(ctx, stQueries[0].query, stQueries[0].args...)
+	}
+
+	var result execResult
+	err = pool.atomic(ctx, func(pool ConnPool) error {
+		for _, q := range stQueries {
+			conn, err := pool.connPool(q.database, false)
+			if err != nil {
+				return err
+			}
+			res, err := conn.ExecContext(ctx, q.query, q.args...)
+			if err != nil {
+				return err
+			}
+			if !q.copy {
+				result = append(result, res)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
 }
 
 // https://github.com/go-gorm/gorm/blob/v1.21.11/callbacks/query.go#L18
 func (pool ConnPool) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
-	ftQuery, stQuery, table, err := pool.sharding.resolve(query, args...)
+	ftQuery, stQueries, merge, table, err := pool.sharding.resolve(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
 
-	pool.sharding.querys.Store("last_query", stQuery)
+	pool.sharding.storeLastQuery(stQueries)
+	if err := pool.pin(table, stQueries); err != nil {
+		return nil, err
+	}
+	read := isRead(query) && !isPrimary(ctx)
 
 	if table != "" {
-		if r, ok := pool.sharding.Resolvers[table]; ok {
+		if r, ok := pool.sharding.resolver(table); ok {
 			if r.EnableFullTable {
 				pool.ConnPool.ExecContext(ctx, ftQuery, args...)
 			}
 		}
 	}
 
-	return pool.ConnPool.QueryContext(ctx, stQuery, args...)
+	if len(stQueries) == 1 {
+		conn, err := pool.connPool(stQueries[0].database, read)
+		if err != nil {
+			return nil, err
+		}
+		return conn.QueryContext(ctx, stQueries[0].query, stQueries[0].args...)
+	}
+
+	set, err := pool.queryAll(ctx, query, stQueries, merge, read)
+	if err != nil {
+		return nil, err
+	}
+
+	return newRows(ctx, set)
 }
 
 func (pool ConnPool) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
-	_, query, _, _ = pool.sharding.resolve(query, args...)
-	pool.sharding.querys.Store("last_query", query)
+	_, stQueries, merge, table, _ := pool.sharding.resolve(ctx, query, args...)
+	pool.sharding.storeLastQuery(stQueries)
+	if err := pool.pin(table, stQueries); err != nil {
+		return errRow(ctx, err)
+	}
+	read := isRead(query) && !isPrimary(ctx)
+
+	if len(stQueries) == 1 {
+		conn, err := pool.connPool(stQueries[0].database, read)
+		if err != nil {
+			return errRow(ctx, err)
+		}
+		return conn.QueryRowContext(ctx, stQueries[0].query, stQueries[0].args...)
+	}
+
+	set, err := pool.queryAll(ctx, query, stQueries, merge, read)
+	if err != nil {
+		return errRow(ctx, err)
+	}
 
-	return pool.ConnPool.QueryRowContext(ctx, query, args...)
+	return newRow(ctx, set)
 }
 
-// BeginTx Implement ConnPoolBeginner.BeginTx
-func (pool *ConnPool) BeginTx(ctx context.Context, opt *sql.TxOptions) (gorm.ConnPool, error) {
-	if basePool, ok := pool.ConnPool.(gorm.ConnPoolBeginner); ok {
-		return basePool.BeginTx(ctx, opt)
+// queryAll runs the queries of query on their sharding tables and merges the rows.
+// The queries of a write, such as INSERT ... RETURNING, run in a transaction.
+func (pool ConnPool) queryAll(ctx context.Context, query string, stQueries []shardQuery, merge *mergePlan, read bool) (*rowSet, error) {
+	if isRead(query) {
+		return pool.queryShards(ctx, stQueries, merge, read)
 	}
 
-	return pool, nil
+	var set *rowSet
+	err := pool.atomic(ctx, func(pool ConnPool) (err error) {
+		set, err = pool.queryShards(ctx, stQueries, merge, false)
+		return err
+	})
+	return set, err
 }
 
-// Implement TxCommitter.Commit
-func (pool *ConnPool) Commit() error {
-	if basePool, ok := pool.ConnPool.(gorm.TxCommitter); ok {
-		return basePool.Commit()
+// queryShards runs the queries on their sharding tables and merges the rows.
+// Inserted rows are returned in the order of the original statement.
+func (pool ConnPool) queryShards(ctx context.Context, stQueries []shardQuery, merge *mergePlan, read bool) (*rowSet, error) {
+	var sets []*rowSet
+	var queries []shardQuery
+	for _, q := range stQueries {
+		conn, err := pool.connPool(q.database, read && !q.copy)
+		if err != nil {
+			return nil, err
+		}
+		rows, err := conn.QueryContext(ctx, q.query, q.args...)
+		if err != nil {
+			return nil, err
+		}
+		set, err := readRows(rows)
+		if err != nil {
+			return nil, err
+		}
+		if !q.copy {
+			sets = append(sets, set)
+			queries = append(queries, q)
+		}
 	}
 
-	return nil
+	if merge != nil {
+		return merge.merge(sets)
+	}
+
+	merged := mergedRowSet(sets)
+	var positions []int
+	ordered := true
+	for i, set := range sets {
+		merged.values = append(merged.values, set.values...)
+		positions = append(positions, queries[i].rows...)
+		ordered = ordered && len(set.values) == len(queries[i].rows)
+	}
+
+	if ordered {
+		values := make([][]driver.Value, len(merged.values))
+		for i, pos := range positions {
+			values[pos] = merged.values[i]
+		}
+		merged.values = values
+	}
+
+	return merged, nil
+}
+
+// connPool returns the connection pool of a database in Sharding.Databases,
+// "" is the database Gorm opened. A read runs on a replica of it if there is any,
+// except in a transaction.
+func (pool ConnPool) connPool(database string, read bool) (gorm.ConnPool, error) {
+	if pool.tx != nil {
+		return pool.tx.conn(database)
+	}
+	if read {
+		if replica, ok := pool.sharding.replica(database); ok {
+			return replica, nil
+		}
+	}
+	if database == "" {
+		return pool.ConnPool, nil
+	}
+	if conn, ok := pool.sharding.Databases[database]; ok {
+		return conn, nil
+	}
+	return nil, fmt.Errorf("database %q is not registered", database)
 }
 
-// Implement TxCommitter.Rollback
-func (pool *ConnPool) Rollback() error {
-	if basePool, ok := pool.ConnPool.(gorm.TxCommitter); ok {
-		return basePool.Rollback()
+// atomic runs fc in a transaction of pool, unless pool is in one already, so the
+// statements of a write on several sharding tables are applied all or none.
+func (pool ConnPool) atomic(ctx context.Context, fc func(pool ConnPool) error) error {
+	if pool.tx != nil {
+		return fc(pool)
 	}
 
-	return nil
+	conn, err := pool.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	tx := conn.(*TxConnPool)
+	if err := fc(tx.ConnPool); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
 }
 
-func (pool *ConnPool) Ping() error {
-	return nil
+// pin checks the statement stays in the shard the transaction is pinned to, see PinShard.
+func (pool ConnPool) pin(table string, stQueries []shardQuery) error {
+	if pool.tx == nil {
+		return nil
+	}
+	return pool.tx.pin(table, stQueries)
+}
+
+// execResult sums up the results of the statements executed on several sharding tables.
+type execResult []sql.Result
+
+func (r execResult) LastInsertId() (int64, error) {
+	if len(r) == 0 {
+		return 0, nil
+	}
+	return r[len(r)-1].LastInsertId()
+}
+
+func (r execResult) RowsAffected() (int64, error) {
+	var total int64
+	for _, res := range r {
+		n, err := res.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		total += n
+	}
+	return total, nil
 }
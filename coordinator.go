@@ -0,0 +1,335 @@
+package sharding
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"gorm.io/gorm"
+)
+
+// errNoLog is returned by Coordinator without Log.
+var errNoLog = errors.New("Log of Coordinator is required")
+
+// ErrInDoubt is wrapped by the error of a transaction which is decided to commit by
+// Coordinator, but not committed on all the databases yet. It is committed on the rest
+// of the databases by Coordinator.Recover.
+var ErrInDoubt = errors.New("transaction is in doubt")
+
+// Coordinator commits a transaction which runs statements on several databases by the
+// two-phase commit of PostgreSQL. The transaction is prepared on each database by
+// PREPARE TRANSACTION, then committed by COMMIT PREPARED, or rolled back by ROLLBACK
+// PREPARED if it fails to prepare on any database. The databases must be configured
+// with max_prepared_transactions greater than 0.
+//
+// The states of the transactions are written to Log, the transactions in doubt after a
+// crash are resolved by Recover when the plugin is initialized.
+//
+//	log, err := sharding.OpenFileLog("/var/lib/app/sharding.log")
+//	middleware.Coordinator = &sharding.Coordinator{Log: log}
+type Coordinator struct {
+	Log RecoveryLog
+}
+
+// TxState is the state of a two-phase commit transaction in RecoveryLog.
+type TxState string
+
+const (
+	// TxPreparing means the transaction is being prepared, it is rolled back by recovery.
+	TxPreparing TxState = "preparing"
+	// TxCommitting means the transaction is prepared on all the databases, and decided
+	// to commit, it is committed by recovery.
+	TxCommitting TxState = "committing"
+	// TxDone means the transaction is committed or rolled back on all the databases.
+	TxDone TxState = "done"
+)
+
+// TxRecord is a state of a two-phase commit transaction.
+type TxRecord struct {
+	// GID identifies the transaction, it is prepared on each database with the position
+	// of the database in Databases appended, such as `sharding_0123abcd_1`.
+	GID   string  `json:"gid"`
+	State TxState `json:"state"`
+	// Databases is the names of the databases the transaction is prepared on, as in
+	// Sharding.Databases. It may be omitted after the record of TxPreparing.
+	Databases []string `json:"databases,omitempty"`
+}
+
+// RecoveryLog keeps the states of the two-phase commit transactions of Coordinator.
+type RecoveryLog interface {
+	// Write records the state of a transaction durably before it returns.
+	Write(record TxRecord) error
+	// InDoubt returns the transactions not done, with their latest state and the
+	// databases they are prepared on.
+	InDoubt() ([]TxRecord, error)
+}
+
+// commit commits the transaction on the databases by two-phase commit, conns are the
+// transactions on the databases and pools are the connection pools out of them.
+func (c *Coordinator) commit(ctx context.Context, databases []string, conns, pools map[string]gorm.ConnPool) error {
+	gid, err := newGID()
+	if err == nil && c.Log == nil {
+		err = errNoLog
+	}
+	if err == nil {
+		err = c.Log.Write(TxRecord{GID: gid, State: TxPreparing, Databases: databases})
+	}
+	if err != nil {
+		for _, database := range databases {
+			conns[database].(gorm.TxCommitter).Rollback()
+		}
+		return err
+	}
+
+	for i, database := range databases {
+		if err := prepare(ctx, conns[database], branchGID(gid, i)); err != nil {
+			for _, rest := range databases[i:] {
+				conns[rest].(gorm.TxCommitter).Rollback()
+			}
+			// The transaction may be prepared on the failed database, such as when
+			// it is not checked in pg_prepared_xacts.
+			c.abort(gid, databases[:i+1], pools)
+			return err
+		}
+		// The transaction is ended to release its connection, the COMMIT after
+		// PREPARE TRANSACTION does nothing on the database.
+		conns[database].(gorm.TxCommitter).Commit()
+	}
+
+	if err := c.Log.Write(TxRecord{GID: gid, State: TxCommitting}); err != nil {
+		c.abort(gid, databases, pools)
+		return err
+	}
+
+	// The transaction is committed on as many databases as possible, the rest are left
+	// to recovery.
+	var failed []string
+	for i, database := range databases {
+		if _, err := pools[database].ExecContext(context.Background(), "COMMIT PREPARED "+quoteGID(branchGID(gid, i))); err != nil {
+			failed = append(failed, fmt.Sprintf("database %q: %v", database, err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%w: %s is not committed on %s", ErrInDoubt, gid, strings.Join(failed, ", "))
+	}
+	// The transaction is committed even if TxDone is not written, Recover commits a
+	// transaction left in TxCommitting again and ignores the committed branches.
+	c.Log.Write(TxRecord{GID: gid, State: TxDone})
+	return nil
+}
+
+// prepare prepares the transaction conn as gid. PostgreSQL rolls back a failed
+// transaction on PREPARE TRANSACTION without an error, so the prepared transaction
+// is checked in pg_prepared_xacts.
+func prepare(ctx context.Context, conn gorm.ConnPool, gid string) error {
+	if _, err := conn.ExecContext(ctx, "PREPARE TRANSACTION "+quoteGID(gid)); err != nil {
+		return err
+	}
+
+	result, err := conn.ExecContext(ctx, "SELECT 1 FROM pg_prepared_xacts WHERE database = current_database() AND gid = "+quoteGID(gid))
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return fmt.Errorf("transaction %s is rolled back by the database on PREPARE TRANSACTION", gid)
+	}
+	return nil
+}
+
+// abort rolls back the transaction prepared on the databases, it is left to recovery
+// if any of them fails.
+func (c *Coordinator) abort(gid string, databases []string, pools map[string]gorm.ConnPool) {
+	for i, database := range databases {
+		if _, err := pools[database].ExecContext(context.Background(), "ROLLBACK PREPARED "+quoteGID(branchGID(gid, i))); err != nil && !isUndefinedObject(err) {
+			return
+		}
+	}
+	c.Log.Write(TxRecord{GID: gid, State: TxDone})
+}
+
+// Recover resolves the transactions in doubt in Log on the connection pools of the
+// databases by name, "" is the database Gorm opened. The transactions decided to
+// commit are committed by COMMIT PREPARED, and the others are rolled back by ROLLBACK
+// PREPARED. It is called when the plugin is initialized.
+func (c *Coordinator) Recover(ctx context.Context, pools map[string]gorm.ConnPool) error {
+	if c.Log == nil {
+		return errNoLog
+	}
+
+	records, err := c.Log.InDoubt()
+	if err != nil {
+		return err
+	}
+
+	for _, record := range records {
+		stmt := "ROLLBACK PREPARED "
+		if record.State == TxCommitting {
+			stmt = "COMMIT PREPARED "
+		}
+		for i, database := range record.Databases {
+			pool, ok := pools[database]
+			if !ok {
+				return fmt.Errorf("database %q of transaction %s is not registered", database, record.GID)
+			}
+			// The transaction is not prepared or resolved already on the database.
+			if _, err := pool.ExecContext(ctx, stmt+quoteGID(branchGID(record.GID, i))); err != nil && !isUndefinedObject(err) {
+				return err
+			}
+		}
+		if err := c.Log.Write(TxRecord{GID: record.GID, State: TxDone}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newGID returns a random transaction identifier.
+func newGID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "sharding_" + hex.EncodeToString(b), nil
+}
+
+// branchGID returns the transaction identifier of gid prepared on the database at
+// position i of its record, as an identifier must be unique in a PostgreSQL cluster,
+// which may hold several of the databases.
+func branchGID(gid string, i int) string {
+	return gid + "_" + strconv.Itoa(i)
+}
+
+// quoteGID quotes a transaction identifier as a string literal.
+func quoteGID(gid string) string {
+	return "'" + strings.ReplaceAll(gid, "'", "''") + "'"
+}
+
+// isUndefinedObject reports whether err is the PostgreSQL error undefined_object (42704),
+// such as a prepared transaction does not exist.
+func isUndefinedObject(err error) bool {
+	var pgErr interface{ SQLState() string }
+	return errors.As(err, &pgErr) && pgErr.SQLState() == "42704"
+}
+
+// FileLog is a RecoveryLog in a file, a JSON record per line.
+type FileLog struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// OpenFileLog opens the FileLog at path, creates it if not exists. The transactions done
+// are removed from the file.
+func OpenFileLog(path string) (*FileLog, error) {
+	records, err := readLog(path)
+	if err != nil {
+		return nil, err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	for _, record := range records {
+		if err := writeRecord(tmp, record); err != nil {
+			tmp.Close()
+			return nil, err
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &FileLog{file: file}, nil
+}
+
+// Write appends record to the file and syncs it.
+func (l *FileLog) Write(record TxRecord) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return writeRecord(l.file, record)
+}
+
+// InDoubt reads the transactions not done from the file.
+func (l *FileLog) InDoubt() ([]TxRecord, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return readLog(l.file.Name())
+}
+
+// Close closes the file.
+func (l *FileLog) Close() error {
+	return l.file.Close()
+}
+
+func writeRecord(file *os.File, record TxRecord) error {
+	b, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// readLog reads the latest states of the transactions not done in the file at path,
+// in the order they are started.
+func readLog(path string) ([]TxRecord, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var gids []string
+	latest := map[string]TxRecord{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record TxRecord
+		// A record partly written by a crash is skipped.
+		if json.Unmarshal(scanner.Bytes(), &record) != nil {
+			continue
+		}
+		prev, ok := latest[record.GID]
+		if !ok {
+			gids = append(gids, record.GID)
+		}
+		if len(record.Databases) == 0 {
+			record.Databases = prev.Databases
+		}
+		latest[record.GID] = record
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	var records []TxRecord
+	for _, gid := range gids {
+		if record := latest[gid]; record.State != TxDone {
+			records = append(records, record)
+		}
+	}
+	return records, nil
+}
@@ -0,0 +1,403 @@
+package sharding
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/longbridgeapp/assert"
+	"gorm.io/gorm"
+)
+
+// statementPool records the statements run on it and its transactions.
+type statementPool struct {
+	name       string
+	statements *[]string
+	fail       string
+	err        error
+	// unprepared means PREPARE TRANSACTION rolls back the transaction.
+	unprepared bool
+}
+
+func (pool *statementPool) record(query string) error {
+	*pool.statements = append(*pool.statements, pool.name+": "+query)
+	if pool.fail != "" && strings.HasPrefix(query, pool.fail) {
+		return pool.err
+	}
+	return nil
+}
+
+func (pool *statementPool) PrepareContext(ctx context.Context, query string) (*sql.Stmt, error) {
+	return nil, errors.New("not supported")
+}
+
+func (pool *statementPool) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	if err := pool.record(query); err != nil {
+		return nil, err
+	}
+	if pool.unprepared && strings.HasPrefix(query, "SELECT 1 FROM pg_prepared_xacts") {
+		return driver.RowsAffected(0), nil
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (pool *statementPool) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return nil, errors.New("not supported")
+}
+
+func (pool *statementPool) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	return nil
+}
+
+func (pool *statementPool) BeginTx(ctx context.Context, opts *sql.TxOptions) (gorm.ConnPool, error) {
+	pool.record("BEGIN")
+	return &statementTx{statementPool: pool}, nil
+}
+
+type statementTx struct {
+	*statementPool
+}
+
+func (tx *statementTx) Commit() error {
+	return tx.record("COMMIT")
+}
+
+func (tx *statementTx) Rollback() error {
+	return tx.record("ROLLBACK")
+}
+
+// doneFailedLog fails to write TxDone to RecoveryLog.
+type doneFailedLog struct {
+	RecoveryLog
+}
+
+func (l doneFailedLog) Write(record TxRecord) error {
+	if record.State == TxDone {
+		return errors.New("disk full")
+	}
+	return l.RecoveryLog.Write(record)
+}
+
+type undefinedObjectError struct{}
+
+func (undefinedObjectError) Error() string    { return "prepared transaction does not exist" }
+func (undefinedObjectError) SQLState() string { return "42704" }
+
+func newCoordinatorSharding(t *testing.T) (*Sharding, *[]string, *FileLog) {
+	log, err := OpenFileLog(filepath.Join(t.TempDir(), "sharding.log"))
+	assert.Equal(t, nil, err)
+	t.Cleanup(func() { log.Close() })
+
+	statements := &[]string{}
+	s := Register(map[string]Resolver{
+		"orders": {
+			ShardingColumn:    "user_id",
+			ShardingAlgorithm: userIDAlgorithm,
+			DatabaseAlgorithm: func(suffix string) (database string, err error) {
+				if suffix >= "_02" {
+					return "db1", nil
+				}
+				return "", nil
+			},
+		},
+	})
+	s.Databases = map[string]gorm.ConnPool{"db1": &statementPool{name: "db1", statements: statements}}
+	s.Coordinator = &Coordinator{Log: log}
+	s.ConnPool = &ConnPool{ConnPool: &statementPool{name: "db0", statements: statements}, sharding: &s}
+	return &s, statements, log
+}
+
+// gidStatements replaces the random part of the transaction identifiers in statements with "gid".
+func gidStatements(statements []string) []string {
+	replaced := make([]string, len(statements))
+	for i, stmt := range statements {
+		replaced[i] = gidPattern.ReplaceAllString(stmt, "'gid")
+	}
+	return replaced
+}
+
+var gidPattern = regexp.MustCompile(`'sharding_[0-9a-f]+`)
+
+func TestCoordinatorCommit(t *testing.T) {
+	s, statements, log := newCoordinatorSharding(t)
+	ctx := context.Background()
+
+	pool, err := s.ConnPool.BeginTx(ctx, nil)
+	assert.Equal(t, nil, err)
+	_, err = pool.ExecContext(ctx, "UPDATE orders SET product = 'a' WHERE user_id = 1")
+	assert.Equal(t, nil, err)
+	_, err = pool.ExecContext(ctx, "UPDATE orders SET product = 'b' WHERE user_id = 2")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, pool.(gorm.TxCommitter).Commit())
+
+	assert.Equal(t, []string{
+		"db0: BEGIN",
+		`db0: UPDATE "orders_01" SET "product" = 'a' WHERE "user_id" = 1`,
+		"db1: BEGIN",
+		`db1: UPDATE "orders_02" SET "product" = 'b' WHERE "user_id" = 2`,
+		"db0: PREPARE TRANSACTION 'gid_0'",
+		"db0: SELECT 1 FROM pg_prepared_xacts WHERE database = current_database() AND gid = 'gid_0'",
+		"db0: COMMIT",
+		"db1: PREPARE TRANSACTION 'gid_1'",
+		"db1: SELECT 1 FROM pg_prepared_xacts WHERE database = current_database() AND gid = 'gid_1'",
+		"db1: COMMIT",
+		"db0: COMMIT PREPARED 'gid_0'",
+		"db1: COMMIT PREPARED 'gid_1'",
+	}, gidStatements(*statements))
+
+	records, err := log.InDoubt()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, len(records))
+}
+
+func TestCoordinatorSingleDatabase(t *testing.T) {
+	s, statements, _ := newCoordinatorSharding(t)
+	ctx := context.Background()
+
+	pool, err := s.ConnPool.BeginTx(ctx, nil)
+	assert.Equal(t, nil, err)
+	_, err = pool.ExecContext(ctx, "UPDATE orders SET product = 'b' WHERE user_id = 2")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, pool.(gorm.TxCommitter).Commit())
+
+	assert.Equal(t, []string{
+		"db0: BEGIN",
+		"db1: BEGIN",
+		`db1: UPDATE "orders_02" SET "product" = 'b' WHERE "user_id" = 2`,
+		"db0: COMMIT",
+		"db1: COMMIT",
+	}, *statements)
+}
+
+func TestCoordinatorPrepareFailed(t *testing.T) {
+	s, statements, log := newCoordinatorSharding(t)
+	db1 := s.Databases["db1"].(*statementPool)
+	db1.fail, db1.err = "PREPARE", errors.New("prepare failed")
+	ctx := context.Background()
+
+	pool, err := s.ConnPool.BeginTx(ctx, nil)
+	assert.Equal(t, nil, err)
+	_, err = pool.ExecContext(ctx, "UPDATE orders SET product = 'a' WHERE user_id = 1")
+	assert.Equal(t, nil, err)
+	_, err = pool.ExecContext(ctx, "UPDATE orders SET product = 'b' WHERE user_id = 2")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, db1.err, pool.(gorm.TxCommitter).Commit())
+
+	assert.Equal(t, []string{
+		"db0: PREPARE TRANSACTION 'gid_0'",
+		"db0: SELECT 1 FROM pg_prepared_xacts WHERE database = current_database() AND gid = 'gid_0'",
+		"db0: COMMIT",
+		"db1: PREPARE TRANSACTION 'gid_1'",
+		"db1: ROLLBACK",
+		"db0: ROLLBACK PREPARED 'gid_0'",
+		"db1: ROLLBACK PREPARED 'gid_1'",
+	}, gidStatements((*statements)[4:]))
+
+	records, err := log.InDoubt()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, len(records))
+}
+
+func TestCoordinatorNotPrepared(t *testing.T) {
+	s, statements, log := newCoordinatorSharding(t)
+	db1 := s.Databases["db1"].(*statementPool)
+	db1.unprepared = true
+	ctx := context.Background()
+
+	pool, err := s.ConnPool.BeginTx(ctx, nil)
+	assert.Equal(t, nil, err)
+	_, err = pool.ExecContext(ctx, "UPDATE orders SET product = 'a' WHERE user_id = 1")
+	assert.Equal(t, nil, err)
+	_, err = pool.ExecContext(ctx, "UPDATE orders SET product = 'b' WHERE user_id = 2")
+	assert.Equal(t, nil, err)
+	err = pool.(gorm.TxCommitter).Commit()
+	assert.Equal(t, true, strings.Contains(err.Error(), "is rolled back by the database on PREPARE TRANSACTION"))
+
+	assert.Equal(t, []string{
+		"db0: PREPARE TRANSACTION 'gid_0'",
+		"db0: SELECT 1 FROM pg_prepared_xacts WHERE database = current_database() AND gid = 'gid_0'",
+		"db0: COMMIT",
+		"db1: PREPARE TRANSACTION 'gid_1'",
+		"db1: SELECT 1 FROM pg_prepared_xacts WHERE database = current_database() AND gid = 'gid_1'",
+		"db1: ROLLBACK",
+		"db0: ROLLBACK PREPARED 'gid_0'",
+		"db1: ROLLBACK PREPARED 'gid_1'",
+	}, gidStatements((*statements)[4:]))
+
+	records, err := log.InDoubt()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, len(records))
+}
+
+func TestCoordinatorCheckPreparedFailed(t *testing.T) {
+	s, statements, log := newCoordinatorSharding(t)
+	db1 := s.Databases["db1"].(*statementPool)
+	db1.fail, db1.err = "SELECT 1 FROM pg_prepared_xacts", errors.New("connection lost")
+	ctx := context.Background()
+
+	pool, err := s.ConnPool.BeginTx(ctx, nil)
+	assert.Equal(t, nil, err)
+	_, err = pool.ExecContext(ctx, "UPDATE orders SET product = 'a' WHERE user_id = 1")
+	assert.Equal(t, nil, err)
+	_, err = pool.ExecContext(ctx, "UPDATE orders SET product = 'b' WHERE user_id = 2")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, db1.err, pool.(gorm.TxCommitter).Commit())
+
+	// The transaction prepared on db1 is rolled back too.
+	assert.Equal(t, []string{
+		"db0: PREPARE TRANSACTION 'gid_0'",
+		"db0: SELECT 1 FROM pg_prepared_xacts WHERE database = current_database() AND gid = 'gid_0'",
+		"db0: COMMIT",
+		"db1: PREPARE TRANSACTION 'gid_1'",
+		"db1: SELECT 1 FROM pg_prepared_xacts WHERE database = current_database() AND gid = 'gid_1'",
+		"db1: ROLLBACK",
+		"db0: ROLLBACK PREPARED 'gid_0'",
+		"db1: ROLLBACK PREPARED 'gid_1'",
+	}, gidStatements((*statements)[4:]))
+
+	records, err := log.InDoubt()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, len(records))
+}
+
+func TestCoordinatorInDoubt(t *testing.T) {
+	s, statements, log := newCoordinatorSharding(t)
+	db1 := s.Databases["db1"].(*statementPool)
+	db1.fail, db1.err = "COMMIT PREPARED", errors.New("connection lost")
+	ctx := context.Background()
+
+	pool, err := s.ConnPool.BeginTx(ctx, nil)
+	assert.Equal(t, nil, err)
+	_, err = pool.ExecContext(ctx, "UPDATE orders SET product = 'a' WHERE user_id = 1")
+	assert.Equal(t, nil, err)
+	_, err = pool.ExecContext(ctx, "UPDATE orders SET product = 'b' WHERE user_id = 2")
+	assert.Equal(t, nil, err)
+	err = pool.(gorm.TxCommitter).Commit()
+	assert.Equal(t, true, errors.Is(err, ErrInDoubt))
+
+	records, err := log.InDoubt()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(records))
+	assert.Equal(t, TxCommitting, records[0].State)
+	assert.Equal(t, []string{"", "db1"}, records[0].Databases)
+
+	*statements = nil
+	db1.fail = ""
+	pools := map[string]gorm.ConnPool{"": s.ConnPool.ConnPool, "db1": db1}
+	s.ConnPool.ConnPool.(*statementPool).fail = "COMMIT PREPARED"
+	s.ConnPool.ConnPool.(*statementPool).err = undefinedObjectError{}
+	assert.Equal(t, nil, s.Coordinator.Recover(ctx, pools))
+	assert.Equal(t, []string{
+		"db0: COMMIT PREPARED 'gid_0'",
+		"db1: COMMIT PREPARED 'gid_1'",
+	}, gidStatements(*statements))
+
+	records, err = log.InDoubt()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, len(records))
+}
+
+func TestCoordinatorCommitAllDatabases(t *testing.T) {
+	s, statements, log := newCoordinatorSharding(t)
+	db0 := s.ConnPool.ConnPool.(*statementPool)
+	db0.fail, db0.err = "COMMIT PREPARED", errors.New("connection lost")
+	ctx := context.Background()
+
+	pool, err := s.ConnPool.BeginTx(ctx, nil)
+	assert.Equal(t, nil, err)
+	_, err = pool.ExecContext(ctx, "UPDATE orders SET product = 'a' WHERE user_id = 1")
+	assert.Equal(t, nil, err)
+	_, err = pool.ExecContext(ctx, "UPDATE orders SET product = 'b' WHERE user_id = 2")
+	assert.Equal(t, nil, err)
+	err = pool.(gorm.TxCommitter).Commit()
+	assert.Equal(t, true, errors.Is(err, ErrInDoubt))
+	assert.Equal(t, true, strings.HasSuffix(err.Error(), `is not committed on database "": connection lost`))
+
+	n := len(*statements)
+	assert.Equal(t, []string{
+		"db0: COMMIT PREPARED 'gid_0'",
+		"db1: COMMIT PREPARED 'gid_1'",
+	}, gidStatements((*statements)[n-2:]))
+
+	records, err := log.InDoubt()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(records))
+}
+
+func TestCoordinatorDoneNotWritten(t *testing.T) {
+	s, statements, log := newCoordinatorSharding(t)
+	s.Coordinator.Log = doneFailedLog{log}
+	ctx := context.Background()
+
+	pool, err := s.ConnPool.BeginTx(ctx, nil)
+	assert.Equal(t, nil, err)
+	_, err = pool.ExecContext(ctx, "UPDATE orders SET product = 'a' WHERE user_id = 1")
+	assert.Equal(t, nil, err)
+	_, err = pool.ExecContext(ctx, "UPDATE orders SET product = 'b' WHERE user_id = 2")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, pool.(gorm.TxCommitter).Commit())
+
+	records, err := log.InDoubt()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(records))
+	assert.Equal(t, TxCommitting, records[0].State)
+
+	// Recover commits the transaction again and ignores the committed branches.
+	*statements = nil
+	s.Coordinator.Log = log
+	db0, db1 := s.ConnPool.ConnPool.(*statementPool), s.Databases["db1"].(*statementPool)
+	db0.fail, db0.err = "COMMIT PREPARED", undefinedObjectError{}
+	db1.fail, db1.err = "COMMIT PREPARED", undefinedObjectError{}
+	pools := map[string]gorm.ConnPool{"": db0, "db1": db1}
+	assert.Equal(t, nil, s.Coordinator.Recover(ctx, pools))
+	assert.Equal(t, []string{
+		"db0: COMMIT PREPARED 'gid_0'",
+		"db1: COMMIT PREPARED 'gid_1'",
+	}, gidStatements(*statements))
+
+	records, err = log.InDoubt()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, len(records))
+}
+
+func TestCoordinatorWithoutLog(t *testing.T) {
+	s, statements, _ := newCoordinatorSharding(t)
+	s.Coordinator = &Coordinator{}
+	ctx := context.Background()
+
+	assert.Equal(t, errNoLog, s.Coordinator.Recover(ctx, nil))
+
+	pool, err := s.ConnPool.BeginTx(ctx, nil)
+	assert.Equal(t, nil, err)
+	_, err = pool.ExecContext(ctx, "UPDATE orders SET product = 'a' WHERE user_id = 1")
+	assert.Equal(t, nil, err)
+	_, err = pool.ExecContext(ctx, "UPDATE orders SET product = 'b' WHERE user_id = 2")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, errNoLog, pool.(gorm.TxCommitter).Commit())
+
+	n := len(*statements)
+	assert.Equal(t, []string{"db0: ROLLBACK", "db1: ROLLBACK"}, (*statements)[n-2:])
+}
+
+func TestFileLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sharding.log")
+	log, err := OpenFileLog(path)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, log.Write(TxRecord{GID: "a", State: TxPreparing, Databases: []string{"", "db1"}}))
+	assert.Equal(t, nil, log.Write(TxRecord{GID: "b", State: TxPreparing, Databases: []string{"db1", "db2"}}))
+	assert.Equal(t, nil, log.Write(TxRecord{GID: "a", State: TxCommitting}))
+	assert.Equal(t, nil, log.Write(TxRecord{GID: "b", State: TxDone}))
+	assert.Equal(t, nil, log.Close())
+
+	log, err = OpenFileLog(path)
+	assert.Equal(t, nil, err)
+	defer log.Close()
+	records, err := log.InDoubt()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []TxRecord{{GID: "a", State: TxCommitting, Databases: []string{"", "db1"}}}, records)
+}
@@ -0,0 +1,214 @@
+package sharding
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/longbridgeapp/sqlparser"
+)
+
+// planHaving moves the HAVING condition out of the statement, it is applied
+// after the groups of all the sharding tables are merged. The aggregates in it
+// are queried as hidden columns.
+func (p *mergePlan) planHaving(stmt *sqlparser.SelectStatement) error {
+	p.having = stmt.HavingCondition
+	p.havingColumns = make(map[*sqlparser.Call]string)
+
+	var calls []*sqlparser.Call
+	sqlparser.Walk(sqlparser.VisitFunc(func(node sqlparser.Node) error {
+		if call, ok := node.(*sqlparser.Call); ok && isAggregate(call) {
+			calls = append(calls, call)
+		}
+		return nil
+	}), stmt.HavingCondition)
+
+	for _, call := range calls {
+		name := fmt.Sprintf("sharding_having_%d", len(p.havingColumns)+1)
+		if err := p.addColumn(stmt, call, name); err != nil {
+			return err
+		}
+		p.havingColumns[call] = name
+	}
+
+	stmt.HavingCondition = nil
+	return nil
+}
+
+// mergeGroups merges the rows of the same group from all the sharding tables,
+// and filters the groups by HAVING. Groups keep the order they first appear.
+func (p *mergePlan) mergeGroups(sets []*rowSet, set *rowSet) ([][]driver.Value, error) {
+	indexes, err := set.indexes(p.groupBy)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	groups := make(map[string][][]driver.Value)
+	for _, s := range sets {
+		for _, row := range s.values {
+			key := groupKey(row, indexes)
+			if _, ok := groups[key]; !ok {
+				keys = append(keys, key)
+			}
+			groups[key] = append(groups[key], row)
+		}
+	}
+
+	var values [][]driver.Value
+	for _, key := range keys {
+		row, err := p.combine(groups[key], set)
+		if err != nil {
+			return nil, err
+		}
+
+		if ok, err := p.filter(row, set); err != nil {
+			return nil, err
+		} else if ok {
+			values = append(values, row)
+		}
+	}
+
+	return values, nil
+}
+
+// filter reports whether the merged row satisfies HAVING.
+func (p *mergePlan) filter(row []driver.Value, set *rowSet) (bool, error) {
+	if p.having == nil {
+		return true, nil
+	}
+	value, err := p.eval(p.having, row, set)
+	return value == true, err
+}
+
+// groupKey encodes the group column values of row, values of different
+// types never share a key.
+func groupKey(row []driver.Value, indexes []int) string {
+	var b strings.Builder
+	for _, idx := range indexes {
+		fmt.Fprintf(&b, "%T:%q;", row[idx], fmt.Sprint(row[idx]))
+	}
+	return b.String()
+}
+
+// eval evaluates the HAVING expression on a merged row. It supports the
+// comparison, logical and arithmetic operators, NULL is returned as nil.
+func (p *mergePlan) eval(expr sqlparser.Expr, row []driver.Value, set *rowSet) (driver.Value, error) {
+	switch x := expr.(type) {
+	case *sqlparser.ParenExpr:
+		return p.eval(x.X, row, set)
+	case *sqlparser.Call:
+		name, ok := p.havingColumns[x]
+		if !ok {
+			return nil, fmt.Errorf("%s in HAVING over multiple sharding tables is not supported", x.String())
+		}
+		return p.column(name, row, set)
+	case *sqlparser.Ident:
+		return p.column(x.Name, row, set)
+	case *sqlparser.QualifiedRef:
+		return p.column(sqlparser.IdentName(x.Column), row, set)
+	case *sqlparser.BindExpr, *sqlparser.StringLit, *sqlparser.NumberLit:
+		value, err := exprValue(x, p.args)
+		if err != nil {
+			return nil, err
+		}
+		return driver.DefaultParameterConverter.ConvertValue(value)
+	case *sqlparser.NullLit:
+		return nil, nil
+	case *sqlparser.BoolLit:
+		return x.Value, nil
+	case *sqlparser.BinaryExpr:
+		return p.evalBinary(x, row, set)
+	}
+	return nil, fmt.Errorf("%s in HAVING over multiple sharding tables is not supported", expr.String())
+}
+
+func (p *mergePlan) evalBinary(expr *sqlparser.BinaryExpr, row []driver.Value, set *rowSet) (driver.Value, error) {
+	x, err := p.eval(expr.X, row, set)
+	if err != nil {
+		return nil, err
+	}
+	y, err := p.eval(expr.Y, row, set)
+	if err != nil {
+		return nil, err
+	}
+
+	switch expr.Op {
+	case sqlparser.AND:
+		if x == false || y == false {
+			return false, nil
+		}
+		if x == nil || y == nil {
+			return nil, nil
+		}
+		return x == true && y == true, nil
+	case sqlparser.OR:
+		if x == true || y == true {
+			return true, nil
+		}
+		if x == nil || y == nil {
+			return nil, nil
+		}
+		return false, nil
+	}
+
+	if x == nil || y == nil {
+		return nil, nil
+	}
+
+	switch expr.Op {
+	case sqlparser.EQ, sqlparser.NE, sqlparser.LG, sqlparser.LT, sqlparser.LE, sqlparser.GT, sqlparser.GE:
+		c := compareValue(x, y, true)
+		switch expr.Op {
+		case sqlparser.EQ:
+			return c == 0, nil
+		case sqlparser.NE, sqlparser.LG:
+			return c != 0, nil
+		case sqlparser.LT:
+			return c < 0, nil
+		case sqlparser.LE:
+			return c <= 0, nil
+		case sqlparser.GT:
+			return c > 0, nil
+		default:
+			return c >= 0, nil
+		}
+	case sqlparser.PLUS, sqlparser.MINUS, sqlparser.STAR, sqlparser.SLASH:
+		a, ok := parseNumber(x)
+		if !ok {
+			return nil, fmt.Errorf("invalid number %v", x)
+		}
+		b, ok := parseNumber(y)
+		if !ok {
+			return nil, fmt.Errorf("invalid number %v", y)
+		}
+
+		r := new(big.Rat)
+		switch expr.Op {
+		case sqlparser.PLUS:
+			r.Add(a, b)
+		case sqlparser.MINUS:
+			r.Sub(a, b)
+		case sqlparser.STAR:
+			r.Mul(a, b)
+		default:
+			if b.Sign() == 0 {
+				return nil, fmt.Errorf("division by zero in HAVING %s", expr.String())
+			}
+			r.Quo(a, b)
+		}
+		f, _ := r.Float64()
+		return f, nil
+	}
+	return nil, fmt.Errorf("%s in HAVING over multiple sharding tables is not supported", expr.String())
+}
+
+// column returns the value of the result column named name.
+func (p *mergePlan) column(name string, row []driver.Value, set *rowSet) (driver.Value, error) {
+	idx := set.columnIndex(name)
+	if idx < 0 {
+		return nil, fmt.Errorf("column %q not found in the result", name)
+	}
+	return row[idx], nil
+}
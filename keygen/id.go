@@ -81,6 +81,12 @@ func TableIdx(id int64) int {
 	return int(id >> int64(tableLeft) & 511)
 }
 
+// Time get the time when the id is generated
+// Give a ID return the time in UTC, in millisecond precision
+func Time(id int64) time.Time {
+	return time.Unix(0, ((id>>int64(timeLeft))+twepoch)*int64(time.Millisecond)).UTC()
+}
+
 // getIPv4 get the IPv4 address
 func getIPv4() (ip net.IP, err error) {
 	addrs, err := net.InterfaceAddrs()
@@ -17,6 +17,15 @@ func TestNext(t *testing.T) {
 	assert.Equal(t, 24, TableIdx(id))
 }
 
+func TestTime(t *testing.T) {
+	before := time.Now().Truncate(time.Millisecond)
+	id := Next(1)
+	after := time.Now()
+
+	assert.Equal(t, true, !Time(id).Before(before) && !Time(id).After(after))
+	assert.Equal(t, time.UTC, Time(id).Location())
+}
+
 func TestNextWithLargerCheck(t *testing.T) {
 	var lastId int64
 	tableIdx := int64(1)
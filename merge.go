@@ -0,0 +1,542 @@
+package sharding
+
+import (
+	"bytes"
+	"container/heap"
+	"database/sql/driver"
+	"fmt"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/longbridgeapp/sqlparser"
+)
+
+// mergePlan describes how to merge the rows queried from several sharding tables.
+type mergePlan struct {
+	// distinct removes the rows of different sharding tables with the same result columns.
+	distinct   bool
+	orderBy    []orderTerm
+	groupBy    []columnRef
+	aggregates []aggregate
+
+	// having is applied on the merged groups, aggregates in it are
+	// queried as the hidden columns in havingColumns.
+	having        sqlparser.Expr
+	havingColumns map[*sqlparser.Call]string
+	args          []interface{}
+
+	// limit is -1 when the query has no LIMIT.
+	limit  int64
+	offset int64
+
+	// hidden is the number of columns appended to the select list for merging,
+	// they are removed from the merged rows.
+	hidden int
+}
+
+// columnRef refers to a result column by name or by 1-based position.
+type columnRef struct {
+	name string
+	pos  int
+}
+
+// orderTerm is an ORDER BY term, resolved to a result column.
+type orderTerm struct {
+	columnRef
+	desc       bool
+	nullsFirst bool
+}
+
+// planMerge plans the merge of a select statement which runs on several sharding tables.
+// The statement is rewritten for the sharding tables: each table returns offset+limit rows,
+// and the ORDER BY terms missing from the select list are appended to it.
+// Grouped statements return all the groups, HAVING and LIMIT are applied after merge.
+func planMerge(stmt *sqlparser.SelectStatement, args []interface{}) (*mergePlan, error) {
+	plan := &mergePlan{limit: -1, args: args, distinct: stmt.Distinct}
+
+	if err := planAggregates(stmt, plan); err != nil {
+		return nil, err
+	}
+
+	hasStar, names := outputNames(stmt.Columns)
+	for i, expr := range stmt.GroupingElements {
+		ref, err := plan.columnRef(stmt, expr, hasStar, names, fmt.Sprintf("sharding_group_%d", i+1))
+		if err != nil {
+			return nil, err
+		}
+		plan.groupBy = append(plan.groupBy, ref)
+	}
+
+	if stmt.HavingCondition != nil {
+		if err := plan.planHaving(stmt); err != nil {
+			return nil, err
+		}
+	}
+
+	for i, term := range stmt.OrderBy {
+		ref, err := plan.columnRef(stmt, term.X, hasStar, names, fmt.Sprintf("sharding_order_%d", i+1))
+		if err != nil {
+			return nil, err
+		}
+		plan.orderBy = append(plan.orderBy, orderTerm{
+			columnRef:  ref,
+			desc:       term.Desc,
+			nullsFirst: term.NullsFirst || (term.Desc && !term.NullsLast),
+		})
+	}
+
+	if stmt.Limit != nil {
+		limit, err := exprInt(stmt.Limit, args)
+		if err != nil {
+			return nil, err
+		}
+		if stmt.Offset != nil {
+			if plan.offset, err = exprInt(stmt.Offset, args); err != nil {
+				return nil, err
+			}
+		}
+		plan.limit = limit
+		stmt.Limit = &sqlparser.NumberLit{Value: strconv.FormatInt(plan.offset+limit, 10)}
+		stmt.Offset = nil
+		if len(plan.groupBy) > 0 {
+			// A group may have rows in every sharding table.
+			stmt.Limit = nil
+		}
+	}
+
+	return plan, nil
+}
+
+// columnRef resolves expr to a result column, expr is appended to the
+// select list as a hidden column named name when it is not found there.
+func (p *mergePlan) columnRef(stmt *sqlparser.SelectStatement, expr sqlparser.Expr, hasStar bool, names map[string]bool, name string) (columnRef, error) {
+	var ref columnRef
+	switch x := expr.(type) {
+	case *sqlparser.NumberLit:
+		pos, err := strconv.Atoi(x.Value)
+		if err != nil {
+			return ref, err
+		}
+		ref.pos = pos
+		return ref, nil
+	case *sqlparser.Ident:
+		ref.name = x.Name
+	case *sqlparser.QualifiedRef:
+		ref.name = sqlparser.IdentName(x.Column)
+	}
+
+	if ref.name == "" || (!hasStar && !names[ref.name]) {
+		ref.name = name
+		if err := p.addColumn(stmt, expr, name); err != nil {
+			return ref, err
+		}
+	}
+	return ref, nil
+}
+
+// addColumn appends a hidden column to the select list.
+func (p *mergePlan) addColumn(stmt *sqlparser.SelectStatement, expr sqlparser.Expr, name string) error {
+	if call, ok := expr.(*sqlparser.Call); (!ok || !isAggregate(call)) && containsAggregate(expr) {
+		return fmt.Errorf("aggregate expression %s over multiple sharding tables is not supported", expr.String())
+	}
+
+	col := &sqlparser.ResultColumn{Expr: expr, Alias: &sqlparser.Ident{Name: name}}
+	*stmt.Columns = append(*stmt.Columns, col)
+	p.hidden++
+
+	if call, ok := expr.(*sqlparser.Call); ok && isAggregate(call) {
+		return p.planAggregate(stmt, col, len(*stmt.Columns)-1)
+	}
+	return nil
+}
+
+// outputNames returns the names of the result columns,
+// and whether the select list contains a star.
+func outputNames(columns *sqlparser.OutputNames) (hasStar bool, names map[string]bool) {
+	names = make(map[string]bool)
+	for _, col := range *columns {
+		switch {
+		case col.Star:
+			hasStar = true
+		case col.Alias != nil:
+			names[col.Alias.Name] = true
+		default:
+			switch x := col.Expr.(type) {
+			case *sqlparser.Ident:
+				names[x.Name] = true
+			case *sqlparser.QualifiedRef:
+				if x.Star {
+					hasStar = true
+				} else {
+					names[sqlparser.IdentName(x.Column)] = true
+				}
+			}
+		}
+	}
+	return
+}
+
+// merge merges the rows of the sharding tables, each of them sorted by the ORDER BY terms.
+func (p *mergePlan) merge(sets []*rowSet) (*rowSet, error) {
+	merged := mergedRowSet(sets)
+	if len(sets) == 0 {
+		return merged, nil
+	}
+
+	orderIndexes, err := merged.indexes(orderRefs(p.orderBy))
+	if err != nil {
+		return nil, err
+	}
+
+	want := -1
+	if p.limit >= 0 {
+		want = int(p.offset + p.limit)
+	}
+
+	switch {
+	case len(p.groupBy) > 0:
+		if merged.values, err = p.mergeGroups(sets, merged); err != nil {
+			return nil, err
+		}
+		p.sort(merged, orderIndexes)
+	case len(p.aggregates) > 0:
+		var rows [][]driver.Value
+		for _, set := range sets {
+			rows = append(rows, set.values...)
+		}
+		if len(rows) > 0 {
+			row, err := p.combine(rows, merged)
+			if err != nil {
+				return nil, err
+			}
+			if ok, err := p.filter(row, merged); err != nil {
+				return nil, err
+			} else if ok {
+				merged.values = [][]driver.Value{row}
+			}
+		}
+	case len(p.orderBy) == 0:
+		for _, set := range sets {
+			merged.values = append(merged.values, set.values...)
+		}
+	default:
+		h := &rowHeap{sets: sets, pos: make([]int, len(sets)), indexes: orderIndexes, plan: p}
+		for i, set := range sets {
+			if len(set.values) > 0 {
+				h.shards = append(h.shards, i)
+			}
+		}
+		heap.Init(h)
+
+		seen := make(map[string]bool)
+		for h.Len() > 0 && (want < 0 || len(merged.values) < want) {
+			shard := h.shards[0]
+			if row := sets[shard].values[h.pos[shard]]; !p.duplicate(seen, row, merged) {
+				merged.values = append(merged.values, row)
+			}
+			h.pos[shard]++
+			if h.pos[shard] < len(sets[shard].values) {
+				heap.Fix(h, 0)
+			} else {
+				heap.Pop(h)
+			}
+		}
+	}
+
+	if p.distinct {
+		seen := make(map[string]bool)
+		values := merged.values[:0]
+		for _, row := range merged.values {
+			if !p.duplicate(seen, row, merged) {
+				values = append(values, row)
+			}
+		}
+		merged.values = values
+	}
+
+	if p.limit >= 0 {
+		merged.values = window(merged.values, p.offset, p.limit)
+	}
+
+	merged.dropColumns(p.hidden)
+	return merged, nil
+}
+
+// duplicate reports whether row is in seen for SELECT DISTINCT, and adds it
+// to seen if not. Rows are compared by the result columns, the numbers encoded
+// as text are compared by value.
+func (p *mergePlan) duplicate(seen map[string]bool, row []driver.Value, set *rowSet) bool {
+	if !p.distinct {
+		return false
+	}
+
+	var b strings.Builder
+	for idx := 0; idx < len(row)-p.hidden; idx++ {
+		if set.isNumeric(idx) {
+			if r, ok := parseNumber(row[idx]); ok {
+				fmt.Fprintf(&b, "numeric:%s;", r.RatString())
+				continue
+			}
+		}
+		fmt.Fprintf(&b, "%T:%q;", row[idx], fmt.Sprint(row[idx]))
+	}
+
+	key := b.String()
+	if seen[key] {
+		return true
+	}
+	seen[key] = true
+	return false
+}
+
+// window returns the rows between offset and offset+limit.
+func window(values [][]driver.Value, offset, limit int64) [][]driver.Value {
+	if offset >= int64(len(values)) {
+		return nil
+	}
+	values = values[offset:]
+	if limit < int64(len(values)) {
+		values = values[:limit]
+	}
+	return values
+}
+
+// dropColumns removes the last n columns.
+func (set *rowSet) dropColumns(n int) {
+	if n == 0 {
+		return
+	}
+	keep := len(set.columns) - n
+	set.columns = set.columns[:keep]
+	if set.types != nil {
+		set.types = set.types[:keep]
+	}
+	for i, row := range set.values {
+		set.values[i] = row[:keep]
+	}
+}
+
+func orderRefs(terms []orderTerm) []columnRef {
+	refs := make([]columnRef, len(terms))
+	for i, term := range terms {
+		refs[i] = term.columnRef
+	}
+	return refs
+}
+
+// indexes returns the column indexes of refs.
+func (set *rowSet) indexes(refs []columnRef) ([]int, error) {
+	indexes := make([]int, len(refs))
+	for i, ref := range refs {
+		idx := ref.pos - 1
+		if ref.pos == 0 {
+			idx = set.columnIndex(ref.name)
+		}
+		if idx < 0 || idx >= len(set.columns) {
+			return nil, fmt.Errorf("column %q not found in the result", ref.name)
+		}
+		indexes[i] = idx
+	}
+	return indexes, nil
+}
+
+// sort sorts the merged rows by the ORDER BY terms.
+func (p *mergePlan) sort(set *rowSet, indexes []int) {
+	if len(p.orderBy) == 0 {
+		return
+	}
+	sort.SliceStable(set.values, func(i, j int) bool {
+		return p.compare(set.values[i], set.values[j], indexes, set) < 0
+	})
+}
+
+// rowHeap is used for the k-way merge, it holds the sharding tables which have rows left,
+// ordered by their current row. Equal rows keep the order of the sharding tables.
+type rowHeap struct {
+	sets    []*rowSet
+	pos     []int
+	shards  []int
+	indexes []int
+	plan    *mergePlan
+}
+
+func (h *rowHeap) Len() int { return len(h.shards) }
+
+func (h *rowHeap) Less(i, j int) bool {
+	a, b := h.shards[i], h.shards[j]
+	if c := h.plan.compare(h.sets[a].values[h.pos[a]], h.sets[b].values[h.pos[b]], h.indexes, h.sets[0]); c != 0 {
+		return c < 0
+	}
+	return a < b
+}
+
+func (h *rowHeap) Swap(i, j int) { h.shards[i], h.shards[j] = h.shards[j], h.shards[i] }
+
+func (h *rowHeap) Push(x interface{}) { h.shards = append(h.shards, x.(int)) }
+
+func (h *rowHeap) Pop() interface{} {
+	last := h.shards[len(h.shards)-1]
+	h.shards = h.shards[:len(h.shards)-1]
+	return last
+}
+
+// compare compares two rows by the ORDER BY terms.
+func (p *mergePlan) compare(a, b []driver.Value, indexes []int, set *rowSet) int {
+	for i, term := range p.orderBy {
+		idx := indexes[i]
+		x, y := a[idx], b[idx]
+
+		var c int
+		switch {
+		case x == nil && y == nil:
+			continue
+		case x == nil || y == nil:
+			// NULLs are placed regardless of the sort direction.
+			if (x == nil) == term.nullsFirst {
+				return -1
+			}
+			return 1
+		default:
+			c = compareValue(x, y, set.isNumeric(idx))
+		}
+
+		if term.desc {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// columnIndex returns the index of the column named name, or -1.
+func (set *rowSet) columnIndex(name string) int {
+	for i, column := range set.columns {
+		if column == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// isNumeric reports whether the column holds numbers encoded as text, such as NUMERIC.
+func (set *rowSet) isNumeric(idx int) bool {
+	if set.types == nil {
+		return false
+	}
+	switch set.types[idx].DatabaseTypeName() {
+	case "NUMERIC", "DECIMAL":
+		return true
+	}
+	return false
+}
+
+// compareValue compares two non-nil driver values.
+func compareValue(x, y driver.Value, numeric bool) int {
+	switch x := x.(type) {
+	case int64:
+		switch y := y.(type) {
+		case int64:
+			return compareInt(x, y)
+		case float64:
+			return compareFloat(float64(x), y)
+		}
+	case float64:
+		switch y := y.(type) {
+		case float64:
+			return compareFloat(x, y)
+		case int64:
+			return compareFloat(x, float64(y))
+		}
+	case bool:
+		if y, ok := y.(bool); ok {
+			switch {
+			case x == y:
+				return 0
+			case !x:
+				return -1
+			}
+			return 1
+		}
+	case time.Time:
+		if y, ok := y.(time.Time); ok {
+			switch {
+			case x.Before(y):
+				return -1
+			case x.After(y):
+				return 1
+			}
+			return 0
+		}
+	}
+
+	if numeric {
+		if x, ok := parseNumber(x); ok {
+			if y, ok := parseNumber(y); ok {
+				return x.Cmp(y)
+			}
+		}
+	}
+
+	return bytes.Compare(valueBytes(x), valueBytes(y))
+}
+
+func compareInt(x, y int64) int {
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
+
+func compareFloat(x, y float64) int {
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
+
+// parseNumber parses a driver value as an arbitrary precision number.
+func parseNumber(v driver.Value) (*big.Rat, bool) {
+	switch v := v.(type) {
+	case int64:
+		return new(big.Rat).SetInt64(v), true
+	case float64:
+		r := new(big.Rat)
+		if r.SetFloat64(v) == nil {
+			return nil, false
+		}
+		return r, true
+	case string, []byte:
+		return new(big.Rat).SetString(strings.TrimSpace(string(valueBytes(v))))
+	}
+	return nil, false
+}
+
+func valueBytes(v driver.Value) []byte {
+	switch v := v.(type) {
+	case []byte:
+		return v
+	case string:
+		return []byte(v)
+	}
+	return []byte(fmt.Sprint(v))
+}
+
+// exprInt returns the integer value of a literal or bind parameter.
+func exprInt(expr sqlparser.Expr, args []interface{}) (int64, error) {
+	value, err := exprValue(expr, args)
+	if err != nil {
+		return 0, err
+	}
+	return toInt64(value)
+}
@@ -0,0 +1,115 @@
+package sharding
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+
+	"github.com/longbridgeapp/sqlparser"
+	"gorm.io/gorm"
+)
+
+const usePrimaryKey = "sharding:use_primary"
+
+type primaryContextKey struct{}
+
+// UsePrimary returns a context which sends the reads to the primary databases instead
+// of the replicas, to read the rows just written.
+//
+//	db.WithContext(sharding.UsePrimary(ctx)).Where("user_id", 2).Find(&orders)
+func UsePrimary(ctx context.Context) context.Context {
+	return context.WithValue(ctx, primaryContextKey{}, true)
+}
+
+// Primary is a Gorm scope sends the query to the primary databases instead of the replicas.
+//
+//	db.Scopes(sharding.Primary).Where("user_id", 2).Find(&orders)
+func Primary(db *gorm.DB) *gorm.DB {
+	return db.Set(usePrimaryKey, true)
+}
+
+func primary(db *gorm.DB) {
+	if enabled, ok := db.Get(usePrimaryKey); ok && enabled == true {
+		db.Statement.Context = UsePrimary(db.Statement.Context)
+	}
+}
+
+// isPrimary reports whether the reads in ctx must run on the primary databases.
+func isPrimary(ctx context.Context) bool {
+	enabled, _ := ctx.Value(primaryContextKey{}).(bool)
+	return enabled
+}
+
+// replica returns a replica of database in turn, or false without any.
+func (s *Sharding) replica(database string) (gorm.ConnPool, bool) {
+	replicas := s.Replicas[database]
+	if len(replicas) == 0 {
+		return nil, false
+	}
+	i := atomic.AddUint32(&s.replicaNext, 1)
+	return replicas[int(i)%len(replicas)], true
+}
+
+// isRead reports whether query only reads, a SELECT statement without a locking clause,
+// which can run on a replica.
+func isRead(query string) bool {
+	isSelect, lock := scanSelect(query)
+	return isSelect && lock < 0
+}
+
+// splitLocking splits the locking clause of a SELECT statement, such as FOR UPDATE or
+// FOR SHARE, which is not supported by sqlparser, from query.
+func splitLocking(query string) (stmt, lock string) {
+	isSelect, offset := scanSelect(query)
+	if !isSelect || offset < 0 {
+		return query, ""
+	}
+	runes := []rune(query)
+	return strings.TrimSpace(string(runes[:offset])), string(runes[offset:])
+}
+
+// scanSelect reports whether query is a SELECT statement, and the offset of its locking
+// clause, or -1 without one. A query with a token sqlparser does not know, such as the
+// ~ operator, is not reported as a SELECT statement, as its locking clause can not be found.
+func scanSelect(query string) (isSelect bool, lock int) {
+	lexer := sqlparser.NewLexer(strings.NewReader(query))
+	depth := 0
+	lock = -1
+	for {
+		pos, tok, lit := lexer.Lex()
+		if tok == sqlparser.ILLEGAL {
+			return false, -1
+		}
+		if tok == sqlparser.EOF {
+			return isSelect, -1
+		}
+		if tok == sqlparser.COMMENT || tok == sqlparser.MLCOMMENT {
+			continue
+		}
+		if !isSelect {
+			if tok != sqlparser.SELECT {
+				return false, -1
+			}
+			isSelect = true
+			continue
+		}
+
+		if lock >= 0 {
+			switch strings.ToUpper(lit) {
+			case "UPDATE", "SHARE", "NO", "KEY":
+				return true, lock
+			}
+			lock = -1
+		}
+		switch tok {
+		case sqlparser.LP:
+			depth++
+		case sqlparser.RP:
+			depth--
+		case sqlparser.FOR:
+			if depth == 0 {
+				lock = pos.Offset
+			}
+		}
+	}
+}
@@ -0,0 +1,447 @@
+package sharding
+
+import (
+	"errors"
+
+	"github.com/longbridgeapp/sqlparser"
+)
+
+// shardSet is the set of sharding tables a condition can match.
+type shardSet struct {
+	// all means the condition does not narrow the sharding tables.
+	all bool
+	// unresolved means all is caused by a predicate on the sharding column
+	// which can not be analyzed, such as NOT IN.
+	unresolved bool
+
+	suffixes []string
+}
+
+// and intersects the sharding tables, the order of a is kept.
+func (a shardSet) and(b shardSet) shardSet {
+	switch {
+	case a.all && b.all:
+		return shardSet{all: true, unresolved: a.unresolved || b.unresolved}
+	case a.all:
+		return b
+	case b.all:
+		return a
+	}
+
+	set := shardSet{suffixes: []string{}}
+	for _, suffix := range a.suffixes {
+		if b.contains(suffix) {
+			set.suffixes = append(set.suffixes, suffix)
+		}
+	}
+	return set
+}
+
+// or unions the sharding tables, in the order they first appear.
+func (a shardSet) or(b shardSet) shardSet {
+	if a.all || b.all {
+		return shardSet{all: true, unresolved: (a.all && a.unresolved) || (b.all && b.unresolved)}
+	}
+
+	set := shardSet{suffixes: append([]string{}, a.suffixes...)}
+	for _, suffix := range b.suffixes {
+		if !set.contains(suffix) {
+			set.suffixes = append(set.suffixes, suffix)
+		}
+	}
+	return set
+}
+
+func (a shardSet) contains(suffix string) bool {
+	for _, s := range a.suffixes {
+		if s == suffix {
+			return true
+		}
+	}
+	return false
+}
+
+// inList is an IN predicate on the sharding column, its values are
+// trimmed to those belonging to the sharding table being queried.
+type inList struct {
+	list     *sqlparser.Exprs
+	exprs    []sqlparser.Expr
+	suffixes []string // suffix of each value
+}
+
+// trim keeps the values belonging to suffix, all of them are kept
+// when none belongs to it, as an IN predicate can not be empty.
+func (l inList) trim(suffix string) {
+	var exprs []sqlparser.Expr
+	for i, expr := range l.exprs {
+		if l.suffixes[i] == suffix {
+			exprs = append(exprs, expr)
+		}
+	}
+	if len(exprs) == 0 {
+		exprs = l.exprs
+	}
+	l.list.Exprs = exprs
+}
+
+// router analyzes the predicates on the key columns of the WHERE condition,
+// AND narrows the sharding tables and OR widens them.
+type router struct {
+	columns   map[string]int            // names of the key columns to their position in the key
+	qualified map[string]map[string]int // table name or alias to its key columns
+	keys      int                       // number of the key columns
+
+	args    []interface{}
+	suffix  func(values []interface{}) (string, error)
+	byRange func(begin, end interface{}) ([]string, error)
+
+	lists []inList
+}
+
+// match is the sharding tables matched by a condition, and the values of the key
+// columns given by = or IN which are not a complete key yet, by position.
+type match struct {
+	set    shardSet
+	values map[int][]interface{}
+}
+
+func (rt *router) analyze(expr sqlparser.Expr) (shardSet, error) {
+	m, err := rt.match(expr)
+	return m.set, err
+}
+
+func (rt *router) match(expr sqlparser.Expr) (match, error) {
+	switch x := expr.(type) {
+	case nil:
+		return match{set: shardSet{all: true}}, nil
+	case *sqlparser.ParenExpr:
+		return rt.match(x.X)
+	case *sqlparser.BinaryExpr:
+		switch x.Op {
+		case sqlparser.AND, sqlparser.OR:
+			left, err := rt.match(x.X)
+			if err != nil {
+				return left, err
+			}
+			right, err := rt.match(x.Y)
+			if err != nil {
+				return right, err
+			}
+			if x.Op == sqlparser.OR {
+				return match{set: left.set.or(right.set)}, nil
+			}
+
+			m := match{set: left.set.and(right.set), values: right.values}
+			for idx, values := range left.values {
+				if m.values == nil {
+					m.values = make(map[int][]interface{})
+				}
+				m.values[idx] = values
+			}
+			return rt.complete(m)
+		}
+
+		if !rt.isColumn(x.X) && rt.isColumn(x.Y) {
+			// Analyze `value = column` as `column = value`.
+			if op, ok := mirrorOp(x.Op); ok {
+				x = &sqlparser.BinaryExpr{X: x.Y, Op: op, Y: x.X}
+			}
+		}
+		if rt.isColumn(x.X) {
+			switch {
+			case x.Op == sqlparser.EQ:
+				return rt.analyzeEQ(x)
+			case x.Op == sqlparser.IN && rt.keys == 1:
+				set, err := rt.analyzeIN(x)
+				return match{set: set}, err
+			case x.Op == sqlparser.IN:
+				return rt.analyzeKeyIN(x)
+			case isRangeOp(x.Op) && rt.byRange != nil && rt.keys == 1:
+				set, err := rt.analyzeRange(x)
+				return match{set: set}, err
+			}
+		}
+	}
+
+	return match{set: rt.unknown(expr)}, nil
+}
+
+// complete routes the values when all the key columns are given,
+// to each combination of the values.
+func (rt *router) complete(m match) (match, error) {
+	if len(m.values) < rt.keys {
+		return m, nil
+	}
+
+	combinations := [][]interface{}{{}}
+	for idx := 0; idx < rt.keys; idx++ {
+		var next [][]interface{}
+		for _, values := range combinations {
+			for _, value := range m.values[idx] {
+				next = append(next, append(values[:len(values):len(values)], value))
+			}
+		}
+		combinations = next
+	}
+
+	set := shardSet{suffixes: []string{}}
+	for _, values := range combinations {
+		suffix, err := rt.suffix(values)
+		if err != nil {
+			return m, err
+		}
+		set = set.or(shardSet{suffixes: []string{suffix}})
+	}
+	return match{set: m.set.and(set)}, nil
+}
+
+func (rt *router) analyzeEQ(n *sqlparser.BinaryExpr) (match, error) {
+	value, err := exprValue(n.Y, rt.args)
+	if err == sqlparser.ErrNotImplemented {
+		return match{set: rt.unknown(n)}, nil
+	} else if err != nil {
+		return match{}, err
+	}
+
+	return rt.complete(match{
+		set:    shardSet{all: true},
+		values: map[int][]interface{}{rt.column(n.X): {value}},
+	})
+}
+
+func (rt *router) analyzeIN(n *sqlparser.BinaryExpr) (shardSet, error) {
+	y, ok := n.Y.(*sqlparser.Exprs)
+	if !ok || len(y.Exprs) == 0 {
+		return rt.unknown(n), nil
+	}
+
+	list := inList{list: y, exprs: y.Exprs, suffixes: make([]string, len(y.Exprs))}
+	set := shardSet{}
+	for i, expr := range y.Exprs {
+		value, err := exprValue(expr, rt.args)
+		if err == sqlparser.ErrNotImplemented {
+			return rt.unknown(n), nil
+		} else if err != nil {
+			return shardSet{}, err
+		}
+
+		if list.suffixes[i], err = rt.suffix([]interface{}{value}); err != nil {
+			return shardSet{}, err
+		}
+		set = set.or(shardSet{suffixes: list.suffixes[i : i+1]})
+	}
+
+	rt.lists = append(rt.lists, list)
+	return set, nil
+}
+
+// analyzeKeyIN analyzes an IN predicate on a column of a composite key,
+// its values are not trimmed as their sharding tables depend on the other columns.
+func (rt *router) analyzeKeyIN(n *sqlparser.BinaryExpr) (match, error) {
+	y, ok := n.Y.(*sqlparser.Exprs)
+	if !ok || len(y.Exprs) == 0 {
+		return match{set: rt.unknown(n)}, nil
+	}
+
+	values := make([]interface{}, len(y.Exprs))
+	for i, expr := range y.Exprs {
+		value, err := exprValue(expr, rt.args)
+		if err == sqlparser.ErrNotImplemented {
+			return match{set: rt.unknown(n)}, nil
+		} else if err != nil {
+			return match{}, err
+		}
+		values[i] = value
+	}
+
+	return rt.complete(match{
+		set:    shardSet{all: true},
+		values: map[int][]interface{}{rt.column(n.X): values},
+	})
+}
+
+func (rt *router) analyzeRange(n *sqlparser.BinaryExpr) (shardSet, error) {
+	var bounds keyRange
+	if err := bounds.add(n, rt.args); err != nil {
+		return shardSet{}, err
+	}
+
+	suffixes, err := rt.byRange(bounds.begin, bounds.end)
+	if errors.Is(err, ErrUnorderedRange) {
+		return rt.unknown(n), nil
+	}
+	if err != nil {
+		return shardSet{}, err
+	}
+	return shardSet{suffixes: suffixes}, nil
+}
+
+// addColumn adds a key column of table, at position idx of the key.
+func (rt *router) addColumn(table *sqlparser.TableName, column string, idx int) {
+	if rt.columns == nil {
+		rt.columns = make(map[string]int)
+		rt.qualified = make(map[string]map[string]int)
+	}
+	rt.columns[column] = idx
+	name := refName(table)
+	if rt.qualified[name] == nil {
+		rt.qualified[name] = make(map[string]int)
+	}
+	rt.qualified[name][column] = idx
+	if idx >= rt.keys {
+		rt.keys = idx + 1
+	}
+}
+
+func (rt *router) isColumn(expr sqlparser.Expr) bool {
+	return rt.column(expr) >= 0
+}
+
+// column returns the position of the key column expr refers to, or -1.
+func (rt *router) column(expr sqlparser.Expr) int {
+	switch x := expr.(type) {
+	case *sqlparser.Ident:
+		if idx, ok := rt.columns[x.Name]; ok {
+			return idx
+		}
+	case *sqlparser.QualifiedRef:
+		if idx, ok := rt.qualified[sqlparser.IdentName(x.Table)][sqlparser.IdentName(x.Column)]; ok && !x.Star {
+			return idx
+		}
+	}
+	return -1
+}
+
+// unknown returns all the sharding tables for a predicate which can not be analyzed,
+// it is unresolved when the predicate refers to the column.
+func (rt *router) unknown(expr sqlparser.Expr) shardSet {
+	set := shardSet{all: true}
+	sqlparser.Walk(columnVisitor{rt: rt, found: &set.unresolved}, expr)
+	return set
+}
+
+// columnVisitor finds the references to the key columns,
+// the subqueries are skipped as they are routed on their own.
+type columnVisitor struct {
+	rt    *router
+	found *bool
+}
+
+func (v columnVisitor) Visit(node sqlparser.Node) (sqlparser.Visitor, error) {
+	switch x := node.(type) {
+	case *sqlparser.Exists:
+		return nil, nil
+	case *sqlparser.Ident:
+		if v.rt.isColumn(x) {
+			*v.found = true
+		}
+	}
+	return v, nil
+}
+
+func (v columnVisitor) VisitEnd(node sqlparser.Node) error { return nil }
+
+// route finds the sharding tables matched by the condition, by the sharding columns
+// of the binding tables, or by the primary key of the first table when the sharding
+// columns do not narrow them.
+func (s *Sharding) route(tables []*sqlparser.TableName, condition sqlparser.Expr, args []interface{}) (set shardSet, lists []inList, err error) {
+	r, _ := s.resolver(tables[0].Name.Name)
+	byKey := &router{
+		args:   args,
+		suffix: r.shardingSuffix,
+	}
+	if r.ShardingAlgorithmByRange != nil {
+		byKey.byRange = r.shardingRange
+	}
+	for _, table := range tables {
+		tr, _ := s.resolver(table.Name.Name)
+		for idx, column := range tr.shardingColumns() {
+			byKey.addColumn(table, column, idx)
+		}
+	}
+	if set, err = byKey.analyze(condition); err != nil || !set.all {
+		return set, byKey.lists, err
+	}
+
+	if r.primaryKeyRouter() == nil {
+		return set, nil, nil
+	}
+
+	byID := &router{
+		args:   args,
+		suffix: r.primaryKeySuffix,
+	}
+	byID.addColumn(tables[0], r.primaryKey(), 0)
+	idSet, err := byID.analyze(condition)
+	if err != nil || !idSet.all {
+		return idSet, byID.lists, err
+	}
+
+	return set, nil, nil
+}
+
+// mirrorOp returns the operator of a comparison with its operands swapped.
+func mirrorOp(op sqlparser.Token) (sqlparser.Token, bool) {
+	switch op {
+	case sqlparser.EQ:
+		return sqlparser.EQ, true
+	case sqlparser.LT:
+		return sqlparser.GT, true
+	case sqlparser.LE:
+		return sqlparser.GE, true
+	case sqlparser.GT:
+		return sqlparser.LT, true
+	case sqlparser.GE:
+		return sqlparser.LE, true
+	}
+	return op, false
+}
+
+func isRangeOp(op sqlparser.Token) bool {
+	switch op {
+	case sqlparser.LT, sqlparser.LE, sqlparser.GT, sqlparser.GE, sqlparser.BETWEEN:
+		return true
+	}
+	return false
+}
+
+// keyRange is the range of the sharding key matched by a range predicate,
+// a nil bound means unbounded.
+type keyRange struct {
+	begin, end interface{}
+}
+
+// add narrows the range by a range predicate on the sharding key.
+// Bounds which are not a literal or bind parameter are ignored.
+func (r *keyRange) add(n *sqlparser.BinaryExpr, args []interface{}) error {
+	var begin, end sqlparser.Expr
+	switch n.Op {
+	case sqlparser.GT, sqlparser.GE:
+		begin = n.Y
+	case sqlparser.LT, sqlparser.LE:
+		end = n.Y
+	case sqlparser.BETWEEN:
+		if y, ok := n.Y.(*sqlparser.Range); ok {
+			begin, end = y.X, y.Y
+		}
+	}
+
+	var err error
+	if r.begin, err = boundValue(begin, args, r.begin); err != nil {
+		return err
+	}
+	r.end, err = boundValue(end, args, r.end)
+	return err
+}
+
+// boundValue returns the value of a range bound, or current when it is unknown.
+func boundValue(expr sqlparser.Expr, args []interface{}, current interface{}) (interface{}, error) {
+	if expr == nil {
+		return current, nil
+	}
+	value, err := exprValue(expr, args)
+	if err == sqlparser.ErrNotImplemented {
+		return current, nil
+	}
+	return value, err
+}
@@ -0,0 +1,177 @@
+package sharding
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"reflect"
+)
+
+// rowSet is a query result read into memory.
+type rowSet struct {
+	columns []string
+	types   []*sql.ColumnType // types of the columns reported by the driver
+	values  [][]driver.Value
+}
+
+// mergedRowSet returns an empty rowSet with the columns of sets.
+func mergedRowSet(sets []*rowSet) *rowSet {
+	merged := &rowSet{}
+	if len(sets) == 0 {
+		return merged
+	}
+	merged.columns, merged.types = sets[0].columns, sets[0].types
+	for _, set := range sets {
+		// Some drivers, such as SQLite, report the column types by the rows read.
+		if len(set.values) > 0 {
+			merged.types = set.types
+			break
+		}
+	}
+	return merged
+}
+
+// readRows reads all the rows and closes them.
+func readRows(rows *sql.Rows) (*rowSet, error) {
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	set := &rowSet{columns: columns}
+	if columnTypes, err := rows.ColumnTypes(); err == nil {
+		set.types = columnTypes
+	}
+
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		dest := make([]interface{}, len(columns))
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+
+		row := make([]driver.Value, len(columns))
+		for i, value := range values {
+			row[i] = value
+		}
+		set.values = append(set.values, row)
+	}
+
+	return set, rows.Err()
+}
+
+// memDB serves in-memory row sets through database/sql, because merged
+// results from several sharding tables must be returned as *sql.Rows, which
+// can only be created by a driver. It never opens a connection to a database,
+// and the rows report the column types of the sharding tables they are read
+// from, so they are scanned as the rows of a single table.
+var memDB = sql.OpenDB(memConnector{})
+
+var errMemReadOnly = errors.New("in-memory rows are read only")
+
+// newRows returns set as *sql.Rows.
+func newRows(ctx context.Context, set *rowSet) (*sql.Rows, error) {
+	return memDB.QueryContext(ctx, "", set)
+}
+
+// newRow returns the first row of set as *sql.Row.
+func newRow(ctx context.Context, set *rowSet) *sql.Row {
+	return memDB.QueryRowContext(ctx, "", set)
+}
+
+// errRow returns a *sql.Row reporting err.
+func errRow(ctx context.Context, err error) *sql.Row {
+	return memDB.QueryRowContext(ctx, "", err)
+}
+
+type memConnector struct{}
+
+func (memConnector) Connect(context.Context) (driver.Conn, error) { return memConn{}, nil }
+func (memConnector) Driver() driver.Driver                        { return memDriver{} }
+
+type memDriver struct{}
+
+func (memDriver) Open(string) (driver.Conn, error) { return memConn{}, nil }
+
+type memConn struct{}
+
+func (memConn) Prepare(string) (driver.Stmt, error) { return nil, errMemReadOnly }
+func (memConn) Close() error                        { return nil }
+func (memConn) Begin() (driver.Tx, error)           { return nil, errMemReadOnly }
+
+// CheckNamedValue passes the row set through without conversion.
+func (memConn) CheckNamedValue(*driver.NamedValue) error { return nil }
+
+func (memConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if len(args) != 1 {
+		return nil, errMemReadOnly
+	}
+	switch value := args[0].Value.(type) {
+	case *rowSet:
+		return &memRows{set: value}, nil
+	case error:
+		return nil, value
+	default:
+		return nil, errMemReadOnly
+	}
+}
+
+type memRows struct {
+	set *rowSet
+	pos int
+}
+
+func (r *memRows) Columns() []string { return r.set.columns }
+
+func (r *memRows) ColumnTypeDatabaseTypeName(index int) string {
+	if r.set.types == nil {
+		return ""
+	}
+	return r.set.types[index].DatabaseTypeName()
+}
+
+func (r *memRows) ColumnTypeScanType(index int) reflect.Type {
+	if r.set.types == nil {
+		return reflect.TypeOf(new(interface{})).Elem()
+	}
+	return r.set.types[index].ScanType()
+}
+
+func (r *memRows) ColumnTypeNullable(index int) (nullable, ok bool) {
+	if r.set.types == nil {
+		return false, false
+	}
+	return r.set.types[index].Nullable()
+}
+
+func (r *memRows) ColumnTypeLength(index int) (length int64, ok bool) {
+	if r.set.types == nil {
+		return 0, false
+	}
+	return r.set.types[index].Length()
+}
+
+func (r *memRows) ColumnTypePrecisionScale(index int) (precision, scale int64, ok bool) {
+	if r.set.types == nil {
+		return 0, 0, false
+	}
+	return r.set.types[index].DecimalSize()
+}
+
+func (r *memRows) Close() error { return nil }
+
+func (r *memRows) Next(dest []driver.Value) error {
+	if r.pos >= len(r.set.values) {
+		return io.EOF
+	}
+	copy(dest, r.set.values[r.pos])
+	r.pos++
+	return nil
+}
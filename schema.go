@@ -0,0 +1,111 @@
+package sharding
+
+import (
+	"strings"
+
+	"github.com/longbridgeapp/sqlparser"
+)
+
+// schemaSep joins the schema and the name of a schema-qualified table. sqlparser does
+// not support schema-qualified table names, "public"."orders" is parsed as a single
+// name joined by schemaSep, and rendered back by restoreSchema.
+const schemaSep = "\x00"
+
+// joinSchema rewrites the schema-qualified table names after FROM, JOIN, INTO and UPDATE
+// to a single quoted name joined by schemaSep.
+func joinSchema(query string) string {
+	type token struct {
+		offset int
+		tok    sqlparser.Token
+		lit    string
+	}
+
+	var tokens []token
+	lexer := sqlparser.NewLexer(strings.NewReader(query))
+	for {
+		pos, tok, lit := lexer.Lex()
+		if tok == sqlparser.EOF || tok == sqlparser.ILLEGAL {
+			break
+		}
+		if tok != sqlparser.MLCOMMENT {
+			tokens = append(tokens, token{offset: pos.Offset, tok: tok, lit: lit})
+		}
+	}
+
+	isIdent := func(i int) bool {
+		return i < len(tokens) && (tokens[i].tok == sqlparser.IDENT || tokens[i].tok == sqlparser.QIDENT)
+	}
+
+	runes := []rune(query)
+	var b strings.Builder
+	last := 0
+	for i := 1; i+2 < len(tokens); i++ {
+		switch tokens[i-1].tok {
+		case sqlparser.FROM, sqlparser.JOIN, sqlparser.INTO, sqlparser.UPDATE:
+		default:
+			continue
+		}
+		if !isIdent(i) || tokens[i+1].tok != sqlparser.DOT || !isIdent(i+2) {
+			continue
+		}
+
+		end := len(runes)
+		if i+3 < len(tokens) {
+			if tokens[i+3].tok == sqlparser.DOT {
+				continue
+			}
+			end = tokens[i+3].offset
+		}
+		for end > tokens[i+2].offset && strings.TrimSpace(string(runes[end-1])) == "" {
+			end--
+		}
+
+		name := &sqlparser.Ident{Name: tokens[i].lit + schemaSep + tokens[i+2].lit}
+		b.WriteString(string(runes[last:tokens[i].offset]))
+		b.WriteString(name.String())
+		last = end
+	}
+	b.WriteString(string(runes[last:]))
+
+	return b.String()
+}
+
+// restoreSchema renders the schema-qualified table names in query as "schema"."table".
+func restoreSchema(query string) string {
+	return strings.ReplaceAll(query, schemaSep, `"."`)
+}
+
+// splitSchema splits a table name to its schema and name.
+func splitSchema(name string) (schema, table string) {
+	if i := strings.Index(name, schemaSep); i >= 0 {
+		return name[:i], name[i+len(schemaSep):]
+	}
+	return "", name
+}
+
+// resolver returns the resolver of a table name, which may be schema-qualified.
+// The resolver keyed by "schema.table" is used first, DefaultSchema is the schema
+// of an unqualified name. Otherwise it falls back to the one keyed by the table name.
+func (s *Sharding) resolver(name string) (Resolver, bool) {
+	schema, table := splitSchema(name)
+	if schema == "" {
+		schema = s.DefaultSchema
+	}
+	if schema != "" {
+		if r, ok := s.Resolvers[schema+"."+table]; ok {
+			return r, true
+		}
+	}
+	r, ok := s.Resolvers[table]
+	return r, ok
+}
+
+// refName returns the name the columns of table are qualified by,
+// its alias or its name without the schema.
+func refName(table *sqlparser.TableName) string {
+	if table.Alias != nil {
+		return sqlparser.IdentName(table.Alias)
+	}
+	_, name := splitSchema(sqlparser.IdentName(table.Name))
+	return name
+}
@@ -1,6 +1,7 @@
 package sharding
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"strconv"
@@ -12,8 +13,11 @@ import (
 )
 
 var (
-	ErrMissingShardingKey = errors.New("sharding key or id required, and use operator =")
-	ErrInvalidID          = errors.New("invalid id format")
+	ErrMissingShardingKey  = errors.New("sharding key or id required, and use operator =")
+	ErrInvalidID           = errors.New("invalid id format")
+	ErrUnresolvedCondition = errors.New("condition on the sharding key can not be resolved to sharding tables")
+	ErrUnorderedRange      = errors.New("sharding tables are not ordered by the sharding key")
+	ErrUnboundTables       = errors.New("sharding tables are not in the same binding group")
 )
 
 type Sharding struct {
@@ -21,10 +25,30 @@ type Sharding struct {
 	ConnPool  *ConnPool
 	Resolvers map[string]Resolver
 
-	querys sync.Map
+	// Databases holds the connection pools of the databases the sharding tables are
+	// distributed in, by name, see DatabaseAlgorithm. The database named "" is the one
+	// Gorm opened. Writes to the broadcast tables are sent to all the databases.
+	Databases map[string]gorm.ConnPool
+
+	// Replicas holds the connection pools of the replicas of the databases, by the name
+	// in Databases, "" for the one Gorm opened. The reads, SELECT statements without a
+	// locking clause such as FOR UPDATE, run on the replicas in turn, and the others on
+	// the primary. Use UsePrimary or the Primary scope to read from the primary.
+	Replicas map[string][]gorm.ConnPool
+
+	// Coordinator commits the transactions on several databases by two-phase commit,
+	// see Coordinator. Without it, the transactions are committed one by one.
+	Coordinator *Coordinator
+
+	// DefaultSchema is the schema of the tables not qualified by a schema in a query,
+	// such as "public", it is used to find the resolvers keyed by "schema.table".
+	DefaultSchema string
+
+	querys      sync.Map
+	replicaNext uint32
 }
 
-//  Resolver composed by five configurable fields.
+// Resolver composed by the configurable fields below.
 type Resolver struct {
 	// EnableFullTable represents whether to enable full table.
 	// When enabled, data will double write to both main table and sharding table.
@@ -34,8 +58,13 @@ type Resolver struct {
 	// For example, for a product order table, you may want to split the rows by `user_id`.
 	ShardingColumn string
 
+	// ShardRouter routes the values of the sharding columns to a sharding table,
+	// such as a built-in Algorithm. ShardingAlgorithm is the shorthand of it,
+	// they can not be configured together.
+	ShardRouter ShardRouter
+
 	// ShardingAlgorithm specifies a function to generate the sharding
-	// table's suffix by the column value.
+	// table's suffix by the column value, a shorthand of ShardRouter.
 	// For example, this function implements a mod sharding algorithm.
 	//
 	// 	func(value interface{}) (suffix string, err error) {
@@ -46,8 +75,35 @@ type Resolver struct {
 	// 	}
 	ShardingAlgorithm func(columnValue interface{}) (suffix string, err error)
 
+	// ShardingColumns specifies the columns of a composite sharding key, used instead
+	// of ShardingColumn. For example, a ledger table split by `tenant_id` and `account_id`.
+	// A query is routed only when all the columns are given by = or IN, ShardRouter
+	// receives the values of the columns in the same order.
+	ShardingColumns []string
+
+	// ShardingColumnType declares the Go type of ShardingColumn by a value of it,
+	// such as int64(0), "" or time.Time{}. The literals and bound values of the sharding
+	// column, including pointers and driver.Valuer such as sql.NullInt64, are converted
+	// to it before calling the sharding algorithms, so `user_id = 1` and `user_id = ?`
+	// are routed the same way. NULL is passed as nil. The values are passed as they are
+	// in the query when it is nil.
+	ShardingColumnType interface{}
+
+	// ShardingColumnTypes declares the Go types of ShardingColumns, in the same order,
+	// as ShardingColumnType does for ShardingColumn. The values of a column with a nil
+	// type are passed as they are in the query.
+	//
+	//	ShardingColumns:     []string{"tenant_id", "region"},
+	//	ShardingColumnTypes: []interface{}{int64(0), ""},
+	ShardingColumnTypes []interface{}
+
+	// PrimaryKeyRouter routes the primary key to a sharding table, used when no sharding
+	// key specified. ShardingAlgorithmByPrimaryKey is the shorthand of it,
+	// they can not be configured together.
+	PrimaryKeyRouter PrimaryKeyRouter
+
 	// ShardingAlgorithmByPrimaryKey specifies a function to generate the sharding
-	// table's suffix by the primary key. Used when no sharding key specified.
+	// table's suffix by an int64 primary key, a shorthand of PrimaryKeyRouter.
 	// For example, this function use the Keygen library to generate the suffix.
 	//
 	// 	func(id int64) (suffix string) {
@@ -55,8 +111,40 @@ type Resolver struct {
 	//	}
 	ShardingAlgorithmByPrimaryKey func(id int64) (suffix string)
 
-	// PrimaryKeyGenerate specifies a function to generate the primary key.
-	// Used only when insert and the record does not contains an id field.
+	// PrimaryKey specifies the name of the primary key column, "id" by default.
+	PrimaryKey string
+
+	// ShardingAlgorithmByRange specifies a function to list the suffixes of the sharding
+	// tables covering the sharding column values between begin and end.
+	// Used for the <, <=, >, >= and BETWEEN predicates on the sharding column,
+	// nil means the range is unbounded on that side. The bounds are always treated
+	// as inclusive, returning one more table is harmless. Return ErrUnorderedRange when
+	// the tables are not ordered by the values, the predicate is then routed like the
+	// one can not be analyzed, see StrictRouting and EnableScatterGather.
+	// For example, this function lists the monthly tables of a time range.
+	//
+	// 	func(begin, end interface{}) (suffixes []string, err error) {
+	//		from, to := firstMonth, time.Now()
+	//		if t, ok := begin.(time.Time); ok && t.After(from) {
+	//			from = t
+	//		}
+	//		if t, ok := end.(time.Time); ok && t.Before(to) {
+	//			to = t
+	//		}
+	//		for m := monthOf(from); !m.After(to); m = m.AddDate(0, 1, 0) {
+	//			suffixes = append(suffixes, m.Format("_200601"))
+	//		}
+	//		return
+	//	}
+	ShardingAlgorithmByRange func(begin, end interface{}) (suffixes []string, err error)
+
+	// PrimaryKeyGenerator generates the primary key, used only when insert and the record
+	// does not contains the primary key. PrimaryKeyGenerate is the shorthand of it,
+	// they can not be configured together.
+	PrimaryKeyGenerator PrimaryKeyGenerator
+
+	// PrimaryKeyGenerate specifies a function to generate an int64 primary key,
+	// a shorthand of PrimaryKeyGenerator.
 	// We recommend you use the
 	// [keygen](https://github.com/longbridgeapp/gorm-sharding/tree/main/keygen) component,
 	// it is a distributed primary key generator.
@@ -68,14 +156,317 @@ type Resolver struct {
 	//		return keygen.Next(tableIdx)
 	//	}
 	PrimaryKeyGenerate func(tableIdx int64) int64
+
+	// EnableScatterGather represents whether a query without sharding key
+	// runs on all the sharding tables instead of returning ErrMissingShardingKey.
+	// It can also be enabled per query with the ScatterGather scope.
+	EnableScatterGather bool
+
+	// ShardingSuffixes specifies a function to list the suffixes of all the sharding tables.
+	// Required by scatter-gather queries.
+	//
+	// 	func() (suffixes []string) {
+	//		for i := 0; i < 64; i++ {
+	//			suffixes = append(suffixes, fmt.Sprintf("_%02d", i))
+	//		}
+	//		return
+	//	}
+	ShardingSuffixes func() (suffixes []string)
+
+	// DatabaseAlgorithm specifies a function to choose the database of a sharding table
+	// by its suffix, the name of a database in Sharding.Databases. The sharding tables
+	// are in the database Gorm opened when it is not configured or returns "".
+	//
+	// 	func(suffix string) (database string, err error) {
+	//		if suffix < "_32" {
+	//			return "db0", nil
+	//		}
+	//		return "db1", nil
+	// 	}
+	DatabaseAlgorithm func(suffix string) (database string, err error)
+
+	// StrictRouting represents whether to return ErrUnresolvedCondition when a predicate
+	// on the sharding column can not be analyzed, such as NOT IN or a function call,
+	// instead of running on all the sharding tables.
+	StrictRouting bool
+
+	// BindingGroup names a group of tables sharded by the same algorithm,
+	// such as orders and order_items both sharded by user_id.
+	// A JOIN between the tables of a group runs on the sharding tables
+	// with the same suffix, routed by the ShardRouter of the first table.
+	BindingGroup string
+
+	// Broadcast represents whether the table is a broadcast table, a small table
+	// which is not sharded, such as products or currencies. It can be joined with
+	// any sharding table, only the sharding table is renamed in the JOIN.
+	// The other fields are ignored for a broadcast table.
+	Broadcast bool
+}
+
+// shardingColumns returns the columns of the sharding key.
+func (r Resolver) shardingColumns() []string {
+	if len(r.ShardingColumns) > 0 {
+		return r.ShardingColumns
+	}
+	return []string{r.ShardingColumn}
+}
+
+// ShardTarget is the sharding table of a sharding key.
+type ShardTarget struct {
+	// Index is the index of the sharding table, which is encoded in the primary key,
+	// from 0 to 511 for keygen.
+	Index int64
+
+	// Suffix is the suffix of the sharding table name, such as `_eu` for `orders_eu`.
+	Suffix string
+}
+
+// ShardRouter routes the values of the sharding columns to a sharding table.
+type ShardRouter interface {
+	// Target returns the sharding table by the values of the sharding columns, in the
+	// same order as ShardingColumns, or the value of ShardingColumn.
+	Target(values []interface{}) (target ShardTarget, err error)
+}
+
+// ShardRouterFunc is a function used as ShardRouter.
+type ShardRouterFunc func(values []interface{}) (target ShardTarget, err error)
+
+// Target calls f(values).
+func (f ShardRouterFunc) Target(values []interface{}) (ShardTarget, error) {
+	return f(values)
+}
+
+// PrimaryKeyRouter routes a primary key to a sharding table.
+type PrimaryKeyRouter interface {
+	// PrimaryKeySuffix returns the suffix of the sharding table by the value of the
+	// primary key, as it is in the query.
+	PrimaryKeySuffix(value interface{}) (suffix string, err error)
+}
+
+// PrimaryKeyRouterFunc is a function used as PrimaryKeyRouter.
+type PrimaryKeyRouterFunc func(value interface{}) (suffix string, err error)
+
+// PrimaryKeySuffix calls f(value).
+func (f PrimaryKeyRouterFunc) PrimaryKeySuffix(value interface{}) (string, error) {
+	return f(value)
+}
+
+// PrimaryKeyGenerator generates the primary keys of the rows inserted.
+type PrimaryKeyGenerator interface {
+	// GeneratePrimaryKey returns a primary key for the sharding table with tableIdx,
+	// the Index of its ShardTarget. An integer key is inserted as a number, others are
+	// inserted as a string formatted by fmt.Sprint, such as the text form of an UUID.
+	GeneratePrimaryKey(tableIdx int64) (value interface{})
+}
+
+// PrimaryKeyGeneratorFunc is a function used as PrimaryKeyGenerator.
+type PrimaryKeyGeneratorFunc func(tableIdx int64) (value interface{})
+
+// GeneratePrimaryKey calls f(tableIdx).
+func (f PrimaryKeyGeneratorFunc) GeneratePrimaryKey(tableIdx int64) interface{} {
+	return f(tableIdx)
+}
+
+// shardRouter returns ShardRouter, or the one of its shorthand configured.
+// It is nil when none of them is configured.
+func (r Resolver) shardRouter() ShardRouter {
+	switch {
+	case r.ShardRouter != nil:
+		return r.ShardRouter
+	case r.ShardingAlgorithm != nil:
+		return suffixRouter(r.ShardingAlgorithm)
+	}
+	return nil
+}
+
+// maxTableIndex is the largest index of a sharding table, keygen encodes it in 9 bits.
+const maxTableIndex = 511
+
+// suffixRouter returns a ShardRouter of ShardingAlgorithm. The index is parsed from
+// the suffix, it is -1 when the suffix is not a table index like `_01`, such as `_eu`
+// or `_202610`, which is out of the range of maxTableIndex.
+func suffixRouter(algorithm func(columnValue interface{}) (suffix string, err error)) ShardRouter {
+	return ShardRouterFunc(func(values []interface{}) (ShardTarget, error) {
+		suffix, err := algorithm(values[0])
+		if err != nil {
+			return ShardTarget{}, err
+		}
+
+		index, err := strconv.ParseInt(strings.Replace(suffix, "_", "", 1), 10, 64)
+		if err != nil || index < 0 || index > maxTableIndex {
+			index = -1
+		}
+		return ShardTarget{Index: index, Suffix: suffix}, nil
+	})
+}
+
+// primaryKeyRouter returns PrimaryKeyRouter, or the one of its shorthand configured.
+// It is nil when none of them is configured.
+func (r Resolver) primaryKeyRouter() PrimaryKeyRouter {
+	switch {
+	case r.PrimaryKeyRouter != nil:
+		return r.PrimaryKeyRouter
+	case r.ShardingAlgorithmByPrimaryKey != nil:
+		return PrimaryKeyRouterFunc(func(value interface{}) (string, error) {
+			id, err := toInt64(value)
+			if err != nil {
+				return "", ErrInvalidID
+			}
+			return r.ShardingAlgorithmByPrimaryKey(id), nil
+		})
+	}
+	return nil
+}
+
+// primaryKeyGenerator returns PrimaryKeyGenerator, or the one of its shorthand configured.
+// It is nil when none of them is configured.
+func (r Resolver) primaryKeyGenerator() PrimaryKeyGenerator {
+	switch {
+	case r.PrimaryKeyGenerator != nil:
+		return r.PrimaryKeyGenerator
+	case r.PrimaryKeyGenerate != nil:
+		return PrimaryKeyGeneratorFunc(func(tableIdx int64) interface{} {
+			return r.PrimaryKeyGenerate(tableIdx)
+		})
+	}
+	return nil
+}
+
+// validate checks a hook and its shorthand are not configured together.
+func (r Resolver) validate() error {
+	if r.Broadcast {
+		return nil
+	}
+
+	switch {
+	case r.ShardRouter != nil && r.ShardingAlgorithm != nil:
+		return errors.New("ShardRouter and ShardingAlgorithm can not be configured together")
+	case r.PrimaryKeyRouter != nil && r.ShardingAlgorithmByPrimaryKey != nil:
+		return errors.New("PrimaryKeyRouter and ShardingAlgorithmByPrimaryKey can not be configured together")
+	case r.PrimaryKeyGenerator != nil && r.PrimaryKeyGenerate != nil:
+		return errors.New("PrimaryKeyGenerator and PrimaryKeyGenerate can not be configured together")
+	case r.shardRouter() == nil:
+		return errors.New("ShardRouter or ShardingAlgorithm is required")
+	case r.ShardingAlgorithm != nil && len(r.ShardingColumns) > 0:
+		return errors.New("ShardingAlgorithm can not route ShardingColumns, use ShardRouter")
+	}
+	if len(r.ShardingColumns) > 0 && r.ShardingColumnType != nil {
+		return errors.New("ShardingColumnType is for ShardingColumn, use ShardingColumnTypes for ShardingColumns")
+	}
+	if r.ShardingColumnTypes != nil && len(r.ShardingColumnTypes) != len(r.ShardingColumns) {
+		return fmt.Errorf("ShardingColumnTypes has %d types for %d ShardingColumns", len(r.ShardingColumnTypes), len(r.ShardingColumns))
+	}
+	return nil
+}
+
+// shardingTarget returns the sharding table by the values of the sharding key.
+func (r Resolver) shardingTarget(values []interface{}) (ShardTarget, error) {
+	values, err := r.normalize(values)
+	if err != nil {
+		return ShardTarget{}, err
+	}
+	return r.shardRouter().Target(values)
+}
+
+// shardingSuffix returns the suffix of the sharding table by the values of the sharding key.
+func (r Resolver) shardingSuffix(values []interface{}) (string, error) {
+	target, err := r.shardingTarget(values)
+	return target.Suffix, err
+}
+
+// shardingRange returns the suffixes of the sharding tables covering the values
+// of the sharding column between begin and end.
+func (r Resolver) shardingRange(begin, end interface{}) ([]string, error) {
+	bounds := []interface{}{begin, end}
+	if sample := r.columnType(0); sample != nil {
+		for i, bound := range bounds {
+			var err error
+			if bounds[i], err = convertValue(bound, sample); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return r.ShardingAlgorithmByRange(bounds[0], bounds[1])
+}
+
+// columnType returns the Go type declared for the sharding column at idx, or nil.
+func (r Resolver) columnType(idx int) interface{} {
+	if len(r.ShardingColumns) > 0 {
+		if idx < len(r.ShardingColumnTypes) {
+			return r.ShardingColumnTypes[idx]
+		}
+		return nil
+	}
+	return r.ShardingColumnType
+}
+
+// normalize converts the values of the sharding columns to their declared types.
+func (r Resolver) normalize(values []interface{}) ([]interface{}, error) {
+	normalized := make([]interface{}, len(values))
+	for i, value := range values {
+		sample := r.columnType(i)
+		if sample == nil {
+			normalized[i] = value
+			continue
+		}
+
+		var err error
+		if normalized[i], err = convertValue(value, sample); err != nil {
+			return nil, err
+		}
+	}
+	return normalized, nil
+}
+
+// database returns the database of the sharding table with suffix.
+func (r Resolver) database(suffix string) (string, error) {
+	if r.DatabaseAlgorithm == nil {
+		return "", nil
+	}
+	return r.DatabaseAlgorithm(suffix)
+}
+
+// primaryKey returns the name of the primary key column.
+func (r Resolver) primaryKey() string {
+	if r.PrimaryKey != "" {
+		return r.PrimaryKey
+	}
+	return "id"
+}
+
+// primaryKeySuffix returns the suffix of the sharding table by the value of the primary key.
+func (r Resolver) primaryKeySuffix(values []interface{}) (string, error) {
+	return r.primaryKeyRouter().PrimaryKeySuffix(values[0])
+}
+
+// generatePrimaryKey generates a primary key for the sharding table tableIdx.
+func (r Resolver) generatePrimaryKey(tableIdx int64) sqlparser.Expr {
+	switch value := r.primaryKeyGenerator().GeneratePrimaryKey(tableIdx).(type) {
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return &sqlparser.NumberLit{Value: fmt.Sprint(value)}
+	default:
+		return &sqlparser.StringLit{Value: fmt.Sprint(value)}
+	}
 }
 
 // Register takes a map, key is the original table name
-// and value is a Resolver.
+// and value is a Resolver. A key qualified by a schema, such as "audit.orders",
+// only applies to the table in that schema, while an unqualified key applies
+// to the table in any schema.
 func Register(resolvers map[string]Resolver) Sharding {
 	return Sharding{Resolvers: resolvers}
 }
 
+// validate checks the resolvers.
+func (s *Sharding) validate() error {
+	for table, r := range s.Resolvers {
+		if err := r.validate(); err != nil {
+			return fmt.Errorf("sharding table %s: %w", table, err)
+		}
+	}
+	return nil
+}
+
 // Name plugin name for Gorm plugin interface
 func (s *Sharding) Name() string {
 	return "gorm:sharding"
@@ -90,241 +481,362 @@ func (s *Sharding) LastQuery() string {
 	return ""
 }
 
+// storeLastQuery keeps the queries sent to the sharding tables, joined by "; ".
+// The copies on other databases are not included.
+func (s *Sharding) storeLastQuery(stQueries []shardQuery) {
+	var queries []string
+	for _, q := range stQueries {
+		if !q.copy {
+			queries = append(queries, q.query)
+		}
+	}
+	s.querys.Store("last_query", strings.Join(queries, "; "))
+}
+
 // Initialize implement for Gorm plugin interface
 func (s *Sharding) Initialize(db *gorm.DB) error {
+	if err := s.validate(); err != nil {
+		return err
+	}
+
 	s.DB = db
 	s.registerConnPool(db)
-	return nil
+	if s.Coordinator != nil {
+		pools := map[string]gorm.ConnPool{"": s.ConnPool.ConnPool}
+		for name, pool := range s.Databases {
+			pools[name] = pool
+		}
+		if err := s.Coordinator.Recover(context.Background(), pools); err != nil {
+			return err
+		}
+	}
+	return s.registerCallbacks(db)
+}
+
+// shardQuery is a query rewritten for a single sharding table.
+type shardQuery struct {
+	query string
+	args  []interface{}
+
+	// rows holds the positions of the inserted rows in the original statement.
+	rows []int
+
+	// suffix is the suffix of the sharding table, "" for a query not routed.
+	suffix string
+	// database is the name of the database to run on, "" is the one Gorm opened.
+	database string
+	// copy means the query is a copy of the previous one on another database,
+	// its result is ignored, such as a write to a broadcast table.
+	copy bool
 }
 
-// resolve split the old query to full table query and sharding table query
-func (s *Sharding) resolve(query string, args ...interface{}) (ftQuery, stQuery, tableName string, err error) {
+// resolve split the old query to full table query and sharding table queries
+func (s *Sharding) resolve(ctx context.Context, query string, args ...interface{}) (ftQuery string, stQueries []shardQuery, merge *mergePlan, tableName string, err error) {
+	// The locking clause is not supported by sqlparser, it is appended to the queries.
+	query, lock := splitLocking(query)
+	if lock != "" {
+		defer func() {
+			ftQuery += " " + lock
+			for i := range stQueries {
+				stQueries[i].query += " " + lock
+			}
+		}()
+	}
+
 	ftQuery = query
-	stQuery = query
+	stQueries = []shardQuery{{query: query, args: args}}
 	if len(s.Resolvers) == 0 {
 		return
 	}
 
-	expr, err := sqlparser.NewParser(strings.NewReader(query)).ParseStatement()
+	// Schema-qualified table names are parsed as a single name, see joinSchema.
+	joined := joinSchema(query)
+	if joined != query {
+		defer func() {
+			ftQuery = restoreSchema(ftQuery)
+			for i := range stQueries {
+				stQueries[i].query = restoreSchema(stQueries[i].query)
+			}
+		}()
+	}
+
+	// WITH queries and IN (SELECT ...) are not supported by sqlparser, see nestSubqueries.
+	nested, with := nestSubqueries(joined)
+	if nested != joined || with != nil {
+		defer func() {
+			ftQuery = unnestSubqueries(ftQuery, with)
+			for i := range stQueries {
+				stQueries[i].query = unnestSubqueries(stQueries[i].query, with)
+			}
+		}()
+	}
+
+	expr, err := sqlparser.NewParser(strings.NewReader(nested)).ParseStatement()
+	if err == nil && with != nil {
+		err = with.attach(expr)
+	}
 	if err != nil {
-		return ftQuery, stQuery, tableName, nil
+		if table, ok := s.unparsedTable(joined); ok {
+			return ftQuery, stQueries, merge, table, &UnsupportedQueryError{Table: table, Err: err}
+		}
+		return ftQuery, stQueries, merge, tableName, nil
 	}
 
-	var table *sqlparser.TableName
+	var tables []*sqlparser.TableName
 	var condition sqlparser.Expr
-	var isInsert bool
-	var insertNames []*sqlparser.Ident
-	var insertValues []sqlparser.Expr
 
 	switch stmt := expr.(type) {
 	case *sqlparser.SelectStatement:
-		tbl, ok := stmt.FromItems.(*sqlparser.TableName)
-		if !ok {
-			return
-		}
 		if stmt.Hint != nil && stmt.Hint.Value == "nosharding" {
 			return
 		}
-		table = tbl
+		tables = sourceTables(stmt.FromItems)
 		condition = stmt.Condition
 
 	case *sqlparser.InsertStatement:
-		table = stmt.TableName
-		isInsert = true
-		insertNames = stmt.ColumnNames
-		insertValues = stmt.Expressions[0].Exprs
+		tables = []*sqlparser.TableName{stmt.TableName}
 	case *sqlparser.UpdateStatement:
 		condition = stmt.Condition
-		table = stmt.TableName
+		tables = []*sqlparser.TableName{stmt.TableName}
 	case *sqlparser.DeleteStatement:
 		condition = stmt.Condition
-		table = stmt.TableName
+		tables = []*sqlparser.TableName{stmt.TableName}
 	default:
-		return ftQuery, stQuery, "", sqlparser.ErrNotImplemented
+		return ftQuery, stQueries, merge, "", sqlparser.ErrNotImplemented
 	}
 
-	tableName = table.Name.Name
-	r, ok := s.Resolvers[tableName]
-	if !ok {
+	source := tables
+	if tables, err = s.bindingTables(tables); err != nil {
 		return
 	}
 
-	var value interface{}
-	var id int64
-	var keyFind bool
-	if isInsert {
-		value, id, keyFind, err = s.insertValue(r.ShardingColumn, insertNames, insertValues, args...)
-		if err != nil {
+	if _, isSelect := expr.(*sqlparser.SelectStatement); !isSelect && len(tables) == 0 && len(s.Databases) > 0 {
+		if r, ok := s.resolver(source[0].Name.Name); ok && r.Broadcast {
+			stQueries = s.broadcast(stQueries[0])
 			return
 		}
-	} else {
-		value, id, keyFind, err = s.nonInsertValue(r.ShardingColumn, condition, args...)
-		if err != nil {
-			return
+	}
+
+	if stmt, ok := expr.(*sqlparser.InsertStatement); ok {
+		if len(tables) > 0 {
+			tableName = tables[0].Name.Name
+			r, _ := s.resolver(tableName)
+			ftQuery, stQueries, err = s.resolveInsert(r, stmt, args...)
 		}
+		return
 	}
 
-	var suffix string
+	subqueries, err := s.routeSubqueries(expr, tables, args)
+	if err != nil {
+		return
+	}
 
-	if keyFind {
-		suffix, err = r.ShardingAlgorithm(value)
-		if err != nil {
+	if len(tables) == 0 {
+		// Only the subqueries are on sharding tables.
+		if len(subqueries) > 0 {
+			tableName = subqueries[0].renames[0].name
+			ftQuery = expr.String()
+			var database string
+			if database, err = s.subqueryDatabase(subqueries, ""); err != nil {
+				return
+			}
+			for _, sub := range subqueries {
+				sub.apply("")
+			}
+			stQueries = []shardQuery{{query: expr.String(), args: args, suffix: subqueries[0].suffix, database: database}}
+		}
+		return
+	}
+	tableName = tables[0].Name.Name
+	r, _ := s.resolver(tableName)
+
+	_, isSelect := expr.(*sqlparser.SelectStatement)
+	scatter := isSelect && (r.EnableScatterGather || isScatterGather(ctx))
+
+	set, lists, err := s.route(tables, condition, args)
+	if err != nil {
+		return
+	}
+
+	suffixes := set.suffixes
+	if set.all {
+		if set.unresolved && r.StrictRouting {
+			err = ErrUnresolvedCondition
 			return
 		}
-	} else {
-		if r.ShardingAlgorithmByPrimaryKey == nil {
-			err = fmt.Errorf("there is not sharding key and ShardingAlgorithmByPrimaryKey is not configured")
+		if !scatter {
+			err = ErrMissingShardingKey
 			return
 		}
-		suffix = r.ShardingAlgorithmByPrimaryKey(id)
+		if r.ShardingSuffixes == nil {
+			err = fmt.Errorf("there is not sharding key and ShardingSuffixes is not configured")
+			return
+		}
+		suffixes = r.ShardingSuffixes()
 	}
 
-	newTable := &sqlparser.TableName{Name: &sqlparser.Ident{Name: tableName + suffix}}
+	ftQuery = expr.String()
+	stQueries = nil
 
-	fillID := true
-	if isInsert {
-		for _, name := range insertNames {
-			if name.Name == "id" {
-				fillID = false
-				break
+	if stmt, ok := expr.(*sqlparser.SelectStatement); ok && len(suffixes) > 1 {
+		merge, err = planMerge(stmt, args)
+		if err != nil {
+			return
+		}
+	}
+
+	renames := newTableRenames(expr, tables)
+	for _, suffix := range suffixes {
+		for _, rename := range renames {
+			rename.apply(suffix)
+		}
+		for _, sub := range subqueries {
+			sub.apply(suffix)
+		}
+
+		query := shardQuery{query: expr.String(), args: args, suffix: suffix}
+		if query.database, err = r.database(suffix); err != nil {
+			return
+		}
+		if len(subqueries) > 0 {
+			var database string
+			if database, err = s.subqueryDatabase(subqueries, suffix); err != nil {
+				return
+			}
+			if database != query.database {
+				err = fmt.Errorf("subquery in database %q can not run with the statement in database %q", database, query.database)
+				return
 			}
 		}
-		if fillID {
-			tblIdx, err := strconv.Atoi(strings.Replace(suffix, "_", "", 1))
+		if len(suffixes) > 1 {
+			// Only keep the IN values belonging to this sharding table.
+			for _, list := range lists {
+				list.trim(suffix)
+			}
+			query.query, query.args, err = rebind(expr, args)
 			if err != nil {
-				return ftQuery, stQuery, tableName, err
+				return
 			}
-			id := r.PrimaryKeyGenerate(int64(tblIdx))
-			insertNames = append(insertNames, &sqlparser.Ident{Name: "id"})
-			insertValues = append(insertValues, &sqlparser.NumberLit{Value: strconv.FormatInt(id, 10)})
 		}
-	}
-
-	switch stmt := expr.(type) {
-	case *sqlparser.InsertStatement:
-		if fillID {
-			stmt.ColumnNames = insertNames
-			stmt.Expressions[0].Exprs = insertValues
-		}
-		ftQuery = stmt.String()
-		stmt.TableName = newTable
-		stQuery = stmt.String()
-	case *sqlparser.SelectStatement:
-		ftQuery = stmt.String()
-		stmt.FromItems = newTable
-		stmt.OrderBy = replaceOrderByTableName(stmt.OrderBy, tableName, newTable.Name.Name)
-		stQuery = stmt.String()
-	case *sqlparser.UpdateStatement:
-		ftQuery = stmt.String()
-		stmt.TableName = newTable
-		stQuery = stmt.String()
-	case *sqlparser.DeleteStatement:
-		ftQuery = stmt.String()
-		stmt.TableName = newTable
-		stQuery = stmt.String()
+		stQueries = append(stQueries, query)
 	}
 
 	return
 }
 
-func (s *Sharding) insertValue(key string, names []*sqlparser.Ident, exprs []sqlparser.Expr, args ...interface{}) (value interface{}, id int64, keyFind bool, err error) {
-	if len(names) != len(exprs) {
-		return nil, 0, keyFind, errors.New("column names and expressions mismatch")
+// resolveInsert groups the inserted rows by sharding table, and fills the
+// primary key of each row when the statement does not contain it.
+func (s *Sharding) resolveInsert(r Resolver, stmt *sqlparser.InsertStatement, args ...interface{}) (ftQuery string, stQueries []shardQuery, err error) {
+	if len(stmt.Expressions) == 0 {
+		return "", nil, ErrMissingShardingKey
 	}
 
-	for i, name := range names {
-		if name.Name == key {
-			switch expr := exprs[i].(type) {
-			case *sqlparser.BindExpr:
-				value, err = getBindValue(expr.Name, args)
-				if err != nil {
-					return nil, 0, keyFind, err
-				}
-			case *sqlparser.StringLit:
-				value = expr.Value
-			case *sqlparser.NumberLit:
-				value = expr.Value
-			default:
-				return nil, 0, keyFind, sqlparser.ErrNotImplemented
-			}
-			keyFind = true
+	insertNames := stmt.ColumnNames
+	fillID := r.primaryKeyGenerator() != nil
+	for _, name := range insertNames {
+		if name.Name == r.primaryKey() {
+			fillID = false
 			break
 		}
 	}
-	if !keyFind {
-		return nil, 0, keyFind, ErrMissingShardingKey
-	}
 
-	return
-}
+	var suffixes []string
+	groups := make(map[string][]int)
+	for i, row := range stmt.Expressions {
+		values, err := s.insertValue(r.shardingColumns(), insertNames, row.Exprs, args...)
+		if err != nil {
+			return "", nil, err
+		}
 
-func (s *Sharding) nonInsertValue(key string, condition sqlparser.Expr, args ...interface{}) (value interface{}, id int64, keyFind bool, err error) {
-	err = sqlparser.Walk(sqlparser.VisitFunc(func(node sqlparser.Node) error {
-		if n, ok := node.(*sqlparser.BinaryExpr); ok {
-			if x, ok := n.X.(*sqlparser.Ident); ok {
-				if x.Name == key && n.Op == sqlparser.EQ {
-					keyFind = true
-					switch expr := n.Y.(type) {
-					case *sqlparser.BindExpr:
-						value, err = getBindValue(expr.Name, args)
-						if err != nil {
-							return err
-						}
-					case *sqlparser.StringLit:
-						value = expr.Value
-					case *sqlparser.NumberLit:
-						value = expr.Value
-					default:
-						return sqlparser.ErrNotImplemented
-					}
-					return nil
-				} else if x.Name == "id" && n.Op == sqlparser.EQ {
-					switch expr := n.Y.(type) {
-					case *sqlparser.BindExpr:
-						v, err := getBindValue(expr.Name, args)
-						if err != nil {
-							return err
-						}
-						var ok bool
-						if id, ok = v.(int64); !ok {
-							return fmt.Errorf("ID should be int64 type")
-						}
-					case *sqlparser.NumberLit:
-						id, err = strconv.ParseInt(expr.Value, 10, 64)
-						if err != nil {
-							return err
-						}
-					default:
-						return ErrInvalidID
-					}
-					return nil
-				}
+		target, err := r.shardingTarget(values)
+		if err != nil {
+			return "", nil, err
+		}
+		suffix := target.Suffix
+
+		if fillID {
+			if target.Index < 0 {
+				return "", nil, fmt.Errorf("table index of the suffix %q is unknown, set the Index of the ShardTarget in ShardRouter to generate the primary key", suffix)
 			}
+			row.Exprs = append(row.Exprs, r.generatePrimaryKey(target.Index))
 		}
-		return nil
-	}), condition)
-	if err != nil {
-		return
+
+		if _, ok := groups[suffix]; !ok {
+			suffixes = append(suffixes, suffix)
+		}
+		groups[suffix] = append(groups[suffix], i)
 	}
 
-	if !keyFind && id == 0 {
-		return nil, 0, keyFind, ErrMissingShardingKey
+	if fillID {
+		stmt.ColumnNames = append(insertNames, &sqlparser.Ident{Name: r.primaryKey()})
+	}
+	ftQuery = stmt.String()
+
+	rows := stmt.Expressions
+	rename := newTableRenames(stmt, []*sqlparser.TableName{stmt.TableName})[0]
+	for _, suffix := range suffixes {
+		rename.apply(suffix)
+		stmt.Expressions = make([]*sqlparser.Exprs, len(groups[suffix]))
+		for i, pos := range groups[suffix] {
+			stmt.Expressions[i] = rows[pos]
+		}
+
+		query := shardQuery{query: stmt.String(), args: args, suffix: suffix, rows: groups[suffix]}
+		if query.database, err = r.database(suffix); err != nil {
+			return "", nil, err
+		}
+		if len(suffixes) > 1 {
+			query.query, query.args, err = rebind(stmt, args)
+			if err != nil {
+				return "", nil, err
+			}
+		}
+		stQueries = append(stQueries, query)
 	}
 
 	return
 }
 
-func replaceOrderByTableName(orderBy []*sqlparser.OrderingTerm, oldName, newName string) []*sqlparser.OrderingTerm {
-	for i, term := range orderBy {
-		if x, ok := term.X.(*sqlparser.QualifiedRef); ok {
-			if x.Table.Name == oldName {
-				x.Table.Name = newName
-				orderBy[i].X = x
+// insertValue returns the values of the key columns in an inserted row,
+// all of them are required.
+func (s *Sharding) insertValue(keys []string, names []*sqlparser.Ident, exprs []sqlparser.Expr, args ...interface{}) (values []interface{}, err error) {
+	if len(names) != len(exprs) {
+		return nil, errors.New("column names and expressions mismatch")
+	}
+
+	values = make([]interface{}, len(keys))
+	for idx, key := range keys {
+		keyFind := false
+		for i, name := range names {
+			if name.Name == key {
+				values[idx], err = exprValue(exprs[i], args)
+				if err != nil {
+					return nil, err
+				}
+				keyFind = true
+				break
 			}
 		}
+		if !keyFind {
+			return nil, ErrMissingShardingKey
+		}
 	}
 
-	return orderBy
+	return
+}
+
+// exprValue returns the value of a literal or bind parameter.
+func exprValue(expr sqlparser.Expr, args []interface{}) (interface{}, error) {
+	switch expr := expr.(type) {
+	case *sqlparser.BindExpr:
+		return getBindValue(expr.Name, args)
+	case *sqlparser.StringLit:
+		return expr.Value, nil
+	case *sqlparser.NumberLit:
+		return expr.Value, nil
+	default:
+		return nil, sqlparser.ErrNotImplemented
+	}
 }
 
 func getBindValue(value interface{}, args []interface{}) (interface{}, error) {
@@ -335,3 +847,42 @@ func getBindValue(value interface{}, args []interface{}) (interface{}, error) {
 	}
 	return args[pos-1], nil
 }
+
+// rebind renumbers the bind parameters of stmt from $1,
+// and returns the query with the args it references.
+func rebind(stmt sqlparser.Statement, args []interface{}) (query string, newArgs []interface{}, err error) {
+	var binds []*sqlparser.BindExpr
+	err = sqlparser.Walk(sqlparser.VisitFunc(func(node sqlparser.Node) error {
+		if n, ok := node.(*sqlparser.BindExpr); ok {
+			binds = append(binds, n)
+		}
+		return nil
+	}), stmt)
+	if err != nil {
+		return
+	}
+
+	names := make([]string, len(binds))
+	positions := make(map[string]int)
+	for i, bind := range binds {
+		names[i] = bind.Name
+		pos, ok := positions[bind.Name]
+		if !ok {
+			value, err := getBindValue(bind.Name, args)
+			if err != nil {
+				return "", nil, err
+			}
+			newArgs = append(newArgs, value)
+			pos = len(newArgs)
+			positions[bind.Name] = pos
+		}
+		bind.Name = "$" + strconv.Itoa(pos)
+	}
+
+	query = stmt.String()
+	for i, bind := range binds {
+		bind.Name = names[i]
+	}
+
+	return
+}
@@ -1,15 +1,21 @@
 package sharding
 
 import (
+	"context"
+	"database/sql"
+	"errors"
 	"fmt"
 	"os"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/longbridgeapp/assert"
 	"github.com/longbridgeapp/gorm-sharding/keygen"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 	"gorm.io/hints"
 )
 
@@ -19,6 +25,48 @@ type Order struct {
 	Product string
 }
 
+type OrderItem struct {
+	ID      int64 `gorm:"primarykey"`
+	OrderID int64
+	UserID  int64
+	Name    string
+}
+
+type Event struct {
+	ID        int64 `gorm:"primarykey"`
+	Name      string
+	CreatedAt time.Time
+}
+
+type Voucher struct {
+	Code   string `gorm:"primarykey"`
+	UserID int64
+	Note   string
+}
+
+type Account struct {
+	ID     int64 `gorm:"primarykey"`
+	Region string
+	Name   string
+}
+
+type Ledger struct {
+	ID        int64 `gorm:"primarykey"`
+	TenantID  int64
+	AccountID int64
+	Amount    int64
+}
+
+var userIDAlgorithm = Modulo(4).Suffix
+
+var eventMonths = Calendar(ByMonth, time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC))
+
+var eventSuffixes = eventMonths.Suffixes()
+
+var ledgerSuffixes = []string{"_00", "_01", "_10", "_11"}
+
+var regions = map[string]int64{"eu": 1, "us": 2}
+
 type Category struct {
 	ID   int64 `gorm:"primarykey"`
 	Name string
@@ -32,6 +80,39 @@ func databaseURL() string {
 	return databaseURL
 }
 
+func databaseURL1() string {
+	databaseURL := os.Getenv("DATABASE_URL_1")
+	if len(databaseURL) == 0 {
+		databaseURL = "postgres://localhost:5432/sharding-test-1?sslmode=disable"
+	}
+	return databaseURL
+}
+
+// recordPool records the queries run on a database in Sharding.Databases.
+type recordPool struct {
+	gorm.ConnPool
+	queries []string
+}
+
+func (pool *recordPool) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	pool.queries = append(pool.queries, query)
+	return pool.ConnPool.ExecContext(ctx, query, args...)
+}
+
+func (pool *recordPool) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	pool.queries = append(pool.queries, query)
+	return pool.ConnPool.QueryContext(ctx, query, args...)
+}
+
+func (pool *recordPool) BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error) {
+	return pool.ConnPool.(gorm.TxBeginner).BeginTx(ctx, opts)
+}
+
+func (pool *recordPool) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	pool.queries = append(pool.queries, query)
+	return pool.ConnPool.QueryRowContext(ctx, query, args...)
+}
+
 var (
 	dbConfig = postgres.Config{
 		DSN:                  databaseURL(),
@@ -41,34 +122,107 @@ var (
 		DisableForeignKeyConstraintWhenMigrating: true,
 	})
 
+	db1Config = postgres.Config{
+		DSN:                  databaseURL1(),
+		PreferSimpleProtocol: true,
+	}
+	db1, _  = gorm.Open(postgres.New(db1Config), &gorm.Config{})
+	db1Pool = &recordPool{ConnPool: db1.ConnPool}
+
+	replicaPool = &recordPool{ConnPool: db.ConnPool}
+
 	sharding = Register(map[string]Resolver{
 		"orders": {
-			EnableFullTable: true,
-			ShardingColumn:  "user_id",
+			EnableFullTable:   true,
+			ShardingColumn:    "user_id",
+			BindingGroup:      "orders",
+			ShardingAlgorithm: userIDAlgorithm,
+			ShardingAlgorithmByPrimaryKey: func(id int64) (suffix string) {
+				return fmt.Sprintf("_%02d", keygen.TableIdx(id))
+			},
+			PrimaryKeyGenerate: func(tableIdx int64) int64 {
+				return keygen.Next(tableIdx)
+			},
+			ShardingSuffixes: func() (suffixes []string) {
+				return []string{"_00", "_01", "_02", "_03"}
+			},
+		},
+		"order_items": {
+			ShardingColumn:    "user_id",
+			ShardingAlgorithm: userIDAlgorithm,
+			BindingGroup:      "orders",
+		},
+		"audit.orders": {
+			ShardingColumn:     "user_id",
+			ShardingColumnType: int64(0),
 			ShardingAlgorithm: func(value interface{}) (suffix string, err error) {
-				userId := 0
-				switch value := value.(type) {
-				case int:
-					userId = value
-				case int64:
-					userId = int(value)
-				case string:
-					userId, err = strconv.Atoi(value)
-					if err != nil {
-						return "", err
-					}
-				default:
-					return "", err
+				if userID, ok := value.(int64); ok {
+					return fmt.Sprintf("_%02d", userID%2), nil
 				}
-				return fmt.Sprintf("_%02d", userId%4), nil
+				return "", fmt.Errorf("invalid user_id %v", value)
 			},
-			ShardingAlgorithmByPrimaryKey: func(id int64) (suffix string) {
-				return fmt.Sprintf("_%02d", keygen.TableIdx(id))
+		},
+		"categories": {
+			Broadcast: true,
+		},
+		"vouchers": {
+			ShardingColumn:    "user_id",
+			ShardingAlgorithm: userIDAlgorithm,
+			PrimaryKey:        "code",
+			PrimaryKeyRouter: PrimaryKeyRouterFunc(func(value interface{}) (suffix string, err error) {
+				if code, ok := value.(string); ok && len(code) > 2 {
+					return "_" + code[:2], nil
+				}
+				return "", ErrInvalidID
+			}),
+			PrimaryKeyGenerator: PrimaryKeyGeneratorFunc(func(tableIdx int64) interface{} {
+				return fmt.Sprintf("%02d-%d", tableIdx, keygen.Next(tableIdx))
+			}),
+			DatabaseAlgorithm: func(suffix string) (database string, err error) {
+				if suffix >= "_02" {
+					return "db1", nil
+				}
+				return "", nil
 			},
+		},
+		"accounts": {
+			ShardingColumn: "region",
+			ShardRouter: ShardRouterFunc(func(values []interface{}) (target ShardTarget, err error) {
+				if region, ok := values[0].(string); ok && regions[region] != 0 {
+					return ShardTarget{Index: regions[region], Suffix: "_" + region}, nil
+				}
+				return ShardTarget{}, errors.New("invalid region")
+			}),
 			PrimaryKeyGenerate: func(tableIdx int64) int64 {
 				return keygen.Next(tableIdx)
 			},
 		},
+		"ledgers": {
+			ShardingColumns:     []string{"tenant_id", "account_id"},
+			ShardingColumnTypes: []interface{}{int64(0), int64(0)},
+			ShardRouter: ShardRouterFunc(func(values []interface{}) (target ShardTarget, err error) {
+				target.Suffix = "_"
+				for _, value := range values {
+					id, ok := value.(int64)
+					if !ok {
+						return ShardTarget{}, fmt.Errorf("invalid ledger key %v", value)
+					}
+					target.Index = target.Index*2 + id%2
+					target.Suffix += strconv.FormatInt(id%2, 10)
+				}
+				return target, nil
+			}),
+		},
+		"events": {
+			ShardingColumn:           "created_at",
+			ShardingColumnType:       time.Time{},
+			ShardRouter:              eventMonths,
+			ShardingAlgorithmByRange: eventMonths.Range,
+			PrimaryKeyRouter:         eventMonths,
+			PrimaryKeyGenerator: PrimaryKeyGeneratorFunc(func(tableIdx int64) interface{} {
+				return keygen.Next(tableIdx)
+			}),
+		},
 	})
 )
 
@@ -87,21 +241,175 @@ func init() {
 		)`)
 	}
 
+	for _, table := range stables {
+		db.Exec(`CREATE TABLE ` + strings.Replace(table, "orders", "order_items", 1) + ` (
+			id bigint PRIMARY KEY,
+			order_id bigint,
+			user_id bigint,
+			name text
+		)`)
+	}
+	for _, suffix := range eventSuffixes {
+		db.Exec(`CREATE TABLE events` + suffix + ` (
+			id bigint PRIMARY KEY,
+			name text,
+			created_at timestamptz
+		)`)
+	}
+	for _, table := range stables {
+		db.Exec(`CREATE TABLE ` + strings.Replace(table, "orders", "vouchers", 1) + ` (
+			code text PRIMARY KEY,
+			user_id bigint,
+			note text
+		)`)
+		db1.Exec(`CREATE TABLE ` + strings.Replace(table, "orders", "vouchers", 1) + ` (
+			code text PRIMARY KEY,
+			user_id bigint,
+			note text
+		)`)
+	}
+	db1.Exec(`CREATE TABLE categories (
+		id bigint PRIMARY KEY,
+		name text
+	)`)
+	for region := range regions {
+		db.Exec(`CREATE TABLE accounts_` + region + ` (
+			id bigint PRIMARY KEY,
+			region text,
+			name text
+		)`)
+	}
+	for _, suffix := range ledgerSuffixes {
+		db.Exec(`CREATE TABLE ledgers` + suffix + ` (
+			id bigint PRIMARY KEY,
+			tenant_id bigint,
+			account_id bigint,
+			amount bigint
+		)`)
+	}
+
+	sharding.Databases = map[string]gorm.ConnPool{"db1": db1Pool}
+	sharding.Replicas = map[string][]gorm.ConnPool{"": {replicaPool}}
 	db.Use(&sharding)
 }
 
 func dropTables() {
-	tables := []string{"orders", "orders_00", "orders_01", "orders_02", "orders_03", "categories"}
+	tables := []string{"orders", "orders_00", "orders_01", "orders_02", "orders_03", "categories",
+		"order_items_00", "order_items_01", "order_items_02", "order_items_03", "events_202601", "events_202602", "events_202603",
+		"vouchers_00", "vouchers_01", "vouchers_02", "vouchers_03", "accounts_eu", "accounts_us", "ledgers_00", "ledgers_01", "ledgers_10", "ledgers_11"}
 	for _, table := range tables {
 		db.Exec("DROP TABLE IF EXISTS " + table)
+		db1.Exec("DROP TABLE IF EXISTS " + table)
 	}
 }
 
+func TestRegisterHooks(t *testing.T) {
+	algorithm := Modulo(4)
+
+	s := Register(map[string]Resolver{
+		"orders": {
+			ShardingColumn:    "user_id",
+			ShardRouter:       algorithm,
+			ShardingAlgorithm: userIDAlgorithm,
+		},
+	})
+	assert.Equal(t, "sharding table orders: ShardRouter and ShardingAlgorithm can not be configured together", s.validate().Error())
+
+	s = Register(map[string]Resolver{
+		"orders": {
+			ShardingColumn:   "user_id",
+			ShardRouter:      algorithm,
+			PrimaryKeyRouter: algorithm,
+			ShardingAlgorithmByPrimaryKey: func(id int64) string {
+				return fmt.Sprintf("_%02d", id%4)
+			},
+		},
+	})
+	assert.Equal(t, "sharding table orders: PrimaryKeyRouter and ShardingAlgorithmByPrimaryKey can not be configured together", s.validate().Error())
+
+	s = Register(map[string]Resolver{
+		"orders": {ShardingColumn: "user_id"},
+	})
+	assert.Equal(t, "sharding table orders: ShardRouter or ShardingAlgorithm is required", s.validate().Error())
+
+	s = Register(map[string]Resolver{
+		"orders": {
+			ShardingColumn:      "user_id",
+			ShardRouter:         algorithm,
+			PrimaryKeyRouter:    algorithm,
+			PrimaryKeyGenerator: PrimaryKeyGeneratorFunc(func(tableIdx int64) interface{} { return tableIdx }),
+		},
+		"categories": {Broadcast: true},
+	})
+	assert.Equal(t, nil, s.validate())
+}
+
+func TestSuffixRouterIndex(t *testing.T) {
+	for suffix, index := range map[string]int64{"_01": 1, "_511": 511, "_512": -1, "_202610": -1, "_eu": -1} {
+		suffix := suffix
+		router := suffixRouter(func(value interface{}) (string, error) { return suffix, nil })
+		target, err := router.Target([]interface{}{int64(1)})
+		assert.Equal(t, nil, err)
+		assert.Equal(t, index, target.Index)
+	}
+
+	s := Register(map[string]Resolver{
+		"events": {
+			ShardingColumn:     "created_at",
+			ShardingAlgorithm:  func(value interface{}) (string, error) { return "_202610", nil },
+			PrimaryKeyGenerate: keygen.Next,
+		},
+	})
+	_, _, _, _, err := s.resolve(context.Background(), `INSERT INTO events (created_at) VALUES ($1)`, time.Now())
+	assert.Equal(t, `table index of the suffix "_202610" is unknown, set the Index of the ShardTarget in ShardRouter to generate the primary key`, err.Error())
+}
+
 func TestInsert(t *testing.T) {
 	tx := db.Create(&Order{ID: 100, UserID: 100, Product: "iPhone"})
 	assertQueryResult(t, `INSERT INTO "orders_00" ("user_id", "product", "id") VALUES ($1, $2, $3) RETURNING "id"`, tx)
 }
 
+func TestInsertMultipleShards(t *testing.T) {
+	orders := []Order{
+		{ID: 200, UserID: 100, Product: "iPhone"},
+		{ID: 201, UserID: 101, Product: "iPad"},
+		{ID: 202, UserID: 104, Product: "Mac"},
+	}
+	tx := db.Create(&orders)
+	assertQueryResult(t, `INSERT INTO "orders_00" ("user_id", "product", "id") VALUES ($1, $2, $3), ($4, $5, $6) RETURNING "id"; INSERT INTO "orders_01" ("user_id", "product", "id") VALUES ($1, $2, $3) RETURNING "id"`, tx)
+	assert.Equal(t, nil, tx.Error)
+	assert.Equal(t, int64(3), tx.RowsAffected)
+	assert.Equal(t, []int64{200, 201, 202}, []int64{orders[0].ID, orders[1].ID, orders[2].ID})
+}
+
+func TestInsertMultipleShardsRollback(t *testing.T) {
+	tx := db.Create(&Order{ID: 212, UserID: 101, Product: "iPad"})
+	assert.Equal(t, nil, tx.Error)
+
+	orders := []Order{
+		{ID: 213, UserID: 100, Product: "iPhone"},
+		{ID: 212, UserID: 101, Product: "iPad"},
+	}
+	tx = db.Create(&orders)
+	assert.NotEqual(t, nil, tx.Error)
+
+	var count int64
+	db.Model(&Order{}).Where("user_id = ? AND id = ?", 100, 213).Count(&count)
+	assert.Equal(t, int64(0), count)
+}
+
+func TestExecMultipleShardsRollback(t *testing.T) {
+	tx := db.Exec("INSERT INTO orders (id, user_id, product) VALUES (?, ?, ?)", 214, 101, "iPad")
+	assert.Equal(t, nil, tx.Error)
+
+	tx = db.Exec("INSERT INTO orders (id, user_id, product) VALUES (?, ?, ?), (?, ?, ?)", 215, 100, "iPhone", 214, 101, "iPad")
+	assert.NotEqual(t, nil, tx.Error)
+
+	var count int64
+	db.Model(&Order{}).Where("user_id = ? AND id = ?", 100, 215).Count(&count)
+	assert.Equal(t, int64(0), count)
+}
+
 func TestFillID(t *testing.T) {
 	db.Create(&Order{UserID: 100, Product: "iPhone"})
 	lastQuery := sharding.LastQuery()
@@ -136,6 +444,10 @@ func TestSelect5(t *testing.T) {
 func TestSelect6(t *testing.T) {
 	tx := db.Model(&Order{}).Where("id", keygen.Next(2)).Find(&[]Order{})
 	assertQueryResult(t, `SELECT * FROM "orders_02" WHERE "id" = $1`, tx)
+
+	tx = db.Model(&Order{}).Where("id", int(keygen.Next(3))).Find(&[]Order{})
+	assertQueryResult(t, `SELECT * FROM "orders_03" WHERE "id" = $1`, tx)
+	assert.Equal(t, nil, tx.Error)
 }
 
 func TestSelect7(t *testing.T) {
@@ -165,7 +477,7 @@ func TestSelect11(t *testing.T) {
 
 func TestSelect12(t *testing.T) {
 	tx := db.Raw(`SELECT * FROM "public"."orders" WHERE "user_id" = 101`).Find(&[]Order{})
-	assertQueryResult(t, `SELECT * FROM "public"."orders" WHERE "user_id" = 101`, tx)
+	assertQueryResult(t, `SELECT * FROM "public"."orders_01" WHERE "user_id" = 101`, tx)
 }
 
 func TestSelect13(t *testing.T) {
@@ -173,6 +485,21 @@ func TestSelect13(t *testing.T) {
 	assertQueryResult(t, `SELECT 1`, tx)
 }
 
+func TestSelectIn(t *testing.T) {
+	tx := db.Model(&Order{}).Where("user_id IN ?", []int64{101, 105}).Find(&[]Order{})
+	assertQueryResult(t, `SELECT * FROM "orders_01" WHERE "user_id" IN ($1, $2)`, tx)
+}
+
+func TestSelectInMultipleShards(t *testing.T) {
+	tx := db.Model(&Order{}).Where("product", "iPad").Where("user_id IN ?", []int64{100, 101, 104}).Find(&[]Order{})
+	assertQueryResult(t, `SELECT * FROM "orders_00" WHERE "product" = $1 AND "user_id" IN ($2, $3); SELECT * FROM "orders_01" WHERE "product" = $1 AND "user_id" IN ($2)`, tx)
+}
+
+func TestSelectInLiteral(t *testing.T) {
+	tx := db.Model(&Order{}).Where("user_id IN (101, 102)").Find(&[]Order{})
+	assertQueryResult(t, `SELECT * FROM "orders_01" WHERE "user_id" IN (101); SELECT * FROM "orders_02" WHERE "user_id" IN (102)`, tx)
+}
+
 func TestUpdate(t *testing.T) {
 	tx := db.Model(&Order{}).Where("user_id = ?", 100).Update("product", "new title")
 	assertQueryResult(t, `UPDATE "orders_00" SET "product" = $1 WHERE "user_id" = $2`, tx)
@@ -183,6 +510,11 @@ func TestDelete(t *testing.T) {
 	assertQueryResult(t, `DELETE FROM "orders_00" WHERE "user_id" = $1`, tx)
 }
 
+func TestUpdateInMultipleShards(t *testing.T) {
+	tx := db.Model(&Order{}).Where("user_id IN ?", []int64{100, 101}).Update("product", "new title")
+	assertQueryResult(t, `UPDATE "orders_00" SET "product" = $1 WHERE "user_id" IN ($2); UPDATE "orders_01" SET "product" = $1 WHERE "user_id" IN ($2)`, tx)
+}
+
 func TestInsertMissingShardingKey(t *testing.T) {
 	err := db.Exec(`INSERT INTO "orders" ("id", "product") VALUES(1, 'iPad')`).Error
 	assert.Equal(t, ErrMissingShardingKey, err)
@@ -193,6 +525,688 @@ func TestSelectMissingShardingKey(t *testing.T) {
 	assert.Equal(t, ErrMissingShardingKey, err)
 }
 
+func TestSelectOrMissingShardingKey(t *testing.T) {
+	err := db.Model(&Order{}).Where("user_id = ? OR product = ?", 101, "iPad").Find(&[]Order{}).Error
+	assert.Equal(t, ErrMissingShardingKey, err)
+}
+
+func TestSelectOrMultipleShards(t *testing.T) {
+	tx := db.Model(&Order{}).Where("(user_id = ? OR user_id = ?) AND product = ?", 101, 102, "iPad").Find(&[]Order{})
+	assertQueryResult(t, `SELECT * FROM "orders_01" WHERE ("user_id" = $1 OR "user_id" = $2) AND "product" = $3; SELECT * FROM "orders_02" WHERE ("user_id" = $1 OR "user_id" = $2) AND "product" = $3`, tx)
+	assert.Equal(t, nil, tx.Error)
+}
+
+func TestSelectAndNarrowsShards(t *testing.T) {
+	tx := db.Model(&Order{}).Where("user_id IN ? AND (user_id = ? OR product = ?)", []int64{101, 102}, 102, "iPad").Find(&[]Order{})
+	assertQueryResult(t, `SELECT * FROM "orders_01" WHERE "user_id" IN ($1) AND ("user_id" = $2 OR "product" = $3); SELECT * FROM "orders_02" WHERE "user_id" IN ($1) AND ("user_id" = $2 OR "product" = $3)`, tx)
+
+	tx = db.Model(&Order{}).Where("user_id IN ? AND user_id = ?", []int64{101, 102}, 102).Find(&[]Order{})
+	assertQueryResult(t, `SELECT * FROM "orders_02" WHERE "user_id" IN ($1, $2) AND "user_id" = $3`, tx)
+}
+
+func TestSelectStrictRouting(t *testing.T) {
+	r := sharding.Resolvers["orders"]
+	r.StrictRouting = true
+	sharding.Resolvers["orders"] = r
+	defer func() {
+		r.StrictRouting = false
+		sharding.Resolvers["orders"] = r
+	}()
+
+	err := db.Scopes(ScatterGather).Model(&Order{}).Where("user_id NOT IN ?", []int64{101}).Find(&[]Order{}).Error
+	assert.Equal(t, ErrUnresolvedCondition, err)
+
+	err = db.Scopes(ScatterGather).Model(&Order{}).Where("user_id = ? AND user_id NOT IN ?", 102, []int64{101}).Find(&[]Order{}).Error
+	assert.Equal(t, nil, err)
+}
+
+func TestSelectScatterGather(t *testing.T) {
+	tx := db.Scopes(ScatterGather).Model(&Order{}).Where("product", "iPad").Find(&[]Order{})
+	assertQueryResult(t, `SELECT * FROM "orders_00" WHERE "product" = $1; SELECT * FROM "orders_01" WHERE "product" = $1; SELECT * FROM "orders_02" WHERE "product" = $1; SELECT * FROM "orders_03" WHERE "product" = $1`, tx)
+	assert.Equal(t, nil, tx.Error)
+}
+
+func TestSelectScatterGatherOrderLimit(t *testing.T) {
+	db.Create(&[]Order{
+		{ID: 300, UserID: 300, Product: "merge"},
+		{ID: 301, UserID: 301, Product: "merge"},
+		{ID: 302, UserID: 302, Product: "merge"},
+		{ID: 303, UserID: 303, Product: "merge"},
+	})
+
+	var orders []Order
+	tx := db.Scopes(ScatterGather).Where("product", "merge").Order("id desc").Limit(2).Offset(1).Find(&orders)
+	assertQueryResult(t, `SELECT * FROM "orders_00" WHERE "product" = $1 ORDER BY "id" DESC LIMIT 3; SELECT * FROM "orders_01" WHERE "product" = $1 ORDER BY "id" DESC LIMIT 3; SELECT * FROM "orders_02" WHERE "product" = $1 ORDER BY "id" DESC LIMIT 3; SELECT * FROM "orders_03" WHERE "product" = $1 ORDER BY "id" DESC LIMIT 3`, tx)
+	assert.Equal(t, nil, tx.Error)
+	assert.Equal(t, 2, len(orders))
+	assert.Equal(t, []int64{302, 301}, []int64{orders[0].ID, orders[1].ID})
+}
+
+func TestSelectScatterGatherOrderByHiddenColumn(t *testing.T) {
+	tx := db.Scopes(ScatterGather).Model(&Order{}).Select("id").Order("product").Find(&[]Order{})
+	assertQueryResult(t, `SELECT "id", "product" AS "sharding_order_1" FROM "orders_00" ORDER BY "product"; SELECT "id", "product" AS "sharding_order_1" FROM "orders_01" ORDER BY "product"; SELECT "id", "product" AS "sharding_order_1" FROM "orders_02" ORDER BY "product"; SELECT "id", "product" AS "sharding_order_1" FROM "orders_03" ORDER BY "product"`, tx)
+}
+
+func TestSelectScatterGatherOrderByText(t *testing.T) {
+	db.Create(&[]Order{
+		{ID: 320, UserID: 320, Product: "collate_a"},
+		{ID: 321, UserID: 321, Product: "Collate_b"},
+	})
+
+	var products []string
+	tx := db.Scopes(ScatterGather).Model(&Order{}).Where("product IN ?", []string{"collate_a", "Collate_b"}).Order("product").Pluck("product", &products)
+	assert.Equal(t, nil, tx.Error)
+	// Text is merged in byte order, as the C collation sorts it.
+	assert.Equal(t, []string{"Collate_b", "collate_a"}, products)
+}
+
+func TestSelectScatterGatherColumnTypes(t *testing.T) {
+	db.Create(&[]Order{
+		{ID: 600, UserID: 600, Product: "column_types"},
+		{ID: 601, UserID: 601, Product: "column_types"},
+	})
+
+	rows, err := db.Model(&Order{}).Where("user_id", 600).Rows()
+	assert.Equal(t, nil, err)
+	columnTypes, err := rows.ColumnTypes()
+	assert.Equal(t, nil, err)
+	rows.Close()
+
+	rows, err = db.Scopes(ScatterGather).Model(&Order{}).Where("product", "column_types").Rows()
+	assert.Equal(t, nil, err)
+	mergedTypes, err := rows.ColumnTypes()
+	assert.Equal(t, nil, err)
+	rows.Close()
+
+	assert.Equal(t, len(columnTypes), len(mergedTypes))
+	for i, columnType := range columnTypes {
+		assert.Equal(t, columnType.DatabaseTypeName(), mergedTypes[i].DatabaseTypeName())
+		assert.Equal(t, columnType.ScanType(), mergedTypes[i].ScanType())
+	}
+}
+
+func TestSelectScatterGatherCount(t *testing.T) {
+	db.Create(&[]Order{
+		{ID: 330, UserID: 330, Product: "count"},
+		{ID: 331, UserID: 331, Product: "count"},
+		{ID: 334, UserID: 334, Product: "count"},
+	})
+
+	var count int64
+	tx := db.Scopes(ScatterGather).Model(&Order{}).Where("product", "count").Count(&count)
+	assertQueryResult(t, `SELECT count(*) FROM "orders_00" WHERE "product" = $1; SELECT count(*) FROM "orders_01" WHERE "product" = $1; SELECT count(*) FROM "orders_02" WHERE "product" = $1; SELECT count(*) FROM "orders_03" WHERE "product" = $1`, tx)
+	assert.Equal(t, nil, tx.Error)
+
+	var sum int64
+	for _, userID := range []int64{330, 331, 334} {
+		var n int64
+		db.Model(&Order{}).Where("user_id = ? AND product = ?", userID, "count").Count(&n)
+		sum += n
+	}
+	assert.Equal(t, int64(3), sum)
+	assert.Equal(t, sum, count)
+}
+
+func TestSelectDistinctMultipleShards(t *testing.T) {
+	db.Create(&[]Order{
+		{ID: 700, UserID: 700, Product: "distinct_a"},
+		{ID: 701, UserID: 701, Product: "distinct_a"},
+		{ID: 702, UserID: 702, Product: "distinct_b"},
+	})
+
+	var products []string
+	tx := db.Scopes(ScatterGather).Model(&Order{}).Distinct("product").Where("product IN ?", []string{"distinct_a", "distinct_b"}).Order("product").Limit(2).Pluck("product", &products)
+	assertQueryResult(t, `SELECT DISTINCT "product" FROM "orders_00" WHERE "product" IN ($1, $2) ORDER BY "product" LIMIT 2; SELECT DISTINCT "product" FROM "orders_01" WHERE "product" IN ($1, $2) ORDER BY "product" LIMIT 2; SELECT DISTINCT "product" FROM "orders_02" WHERE "product" IN ($1, $2) ORDER BY "product" LIMIT 2; SELECT DISTINCT "product" FROM "orders_03" WHERE "product" IN ($1, $2) ORDER BY "product" LIMIT 2`, tx)
+	assert.Equal(t, nil, tx.Error)
+	assert.Equal(t, []string{"distinct_a", "distinct_b"}, products)
+
+	products = nil
+	tx = db.Model(&Order{}).Distinct("product").Where("user_id IN ?", []int64{700, 701, 702}).Pluck("product", &products)
+	assert.Equal(t, nil, tx.Error)
+	assert.Equal(t, 2, len(products))
+}
+
+func TestSelectAggregateMultipleShards(t *testing.T) {
+	db.Create(&[]Order{
+		{ID: 400, UserID: 400, Product: "aggregate"},
+		{ID: 401, UserID: 401, Product: "aggregate"},
+		{ID: 405, UserID: 405, Product: "aggregate"},
+	})
+
+	var result struct {
+		Count int64
+		Sum   int64
+		Min   int64
+		Avg   float64
+	}
+	tx := db.Model(&Order{}).Select("count(*) AS count, sum(id) AS sum, min(id) AS min, avg(user_id)").Where("user_id IN ?", []int64{400, 401, 405}).Scan(&result)
+	assertQueryResult(t, `SELECT count(*) AS "count", sum("id") AS "sum", min("id") AS "min", sum("user_id") AS "avg", count("user_id") AS "sharding_avg_count_4" FROM "orders_00" WHERE "user_id" IN ($1); SELECT count(*) AS "count", sum("id") AS "sum", min("id") AS "min", sum("user_id") AS "avg", count("user_id") AS "sharding_avg_count_4" FROM "orders_01" WHERE "user_id" IN ($1, $2)`, tx)
+	assert.Equal(t, nil, tx.Error)
+	assert.Equal(t, int64(3), result.Count)
+	assert.Equal(t, int64(1206), result.Sum)
+	assert.Equal(t, int64(400), result.Min)
+	assert.Equal(t, float64(402), result.Avg)
+}
+
+func TestSelectGroupByMultipleShards(t *testing.T) {
+	db.Create(&[]Order{
+		{ID: 500, UserID: 500, Product: "group_x"},
+		{ID: 501, UserID: 501, Product: "group_x"},
+		{ID: 504, UserID: 504, Product: "group_y"},
+		{ID: 505, UserID: 505, Product: "group_z"},
+	})
+
+	var results []struct {
+		Product string
+		Count   int64
+		Sum     int64
+	}
+	tx := db.Model(&Order{}).Select("product, count(*) AS count, sum(id) AS sum").Where("user_id IN ?", []int64{500, 501, 504, 505}).Group("product").Having("count(*) > ?", 1).Order("sum DESC").Scan(&results)
+	assertQueryResult(t, `SELECT "product", count(*) AS "count", sum("id") AS "sum", count(*) AS "sharding_having_1" FROM "orders_00" WHERE "user_id" IN ($1, $2) GROUP BY "product" ORDER BY "sum" DESC; SELECT "product", count(*) AS "count", sum("id") AS "sum", count(*) AS "sharding_having_1" FROM "orders_01" WHERE "user_id" IN ($1, $2) GROUP BY "product" ORDER BY "sum" DESC`, tx)
+	assert.Equal(t, nil, tx.Error)
+	assert.Equal(t, 1, len(results))
+	assert.Equal(t, "group_x", results[0].Product)
+	assert.Equal(t, int64(2), results[0].Count)
+	assert.Equal(t, int64(1001), results[0].Sum)
+}
+
+func TestSelectAggregateExpressionMultipleShards(t *testing.T) {
+	db.Create(&[]Order{
+		{ID: 510, UserID: 510, Product: "expression_x"},
+		{ID: 511, UserID: 511, Product: "expression_x"},
+		{ID: 514, UserID: 514, Product: "expression_y"},
+	})
+
+	var results []struct {
+		Product string
+		Count   int64
+	}
+	tx := db.Model(&Order{}).Select("product, count(*) AS count").Where("user_id IN ?", []int64{510, 511, 514}).Group("product").Order("sum(id) / count(*)").Find(&results)
+	assert.Equal(t, "aggregate expression sum(\"id\") / count(*) over multiple sharding tables is not supported", tx.Error.Error())
+
+	// The aggregates in HAVING are merged before the expression is evaluated.
+	results = nil
+	tx = db.Model(&Order{}).Select("product, count(*) AS count").Where("user_id IN ?", []int64{510, 511, 514}).Group("product").Having("sum(id) / count(*) < ?", 512).Scan(&results)
+	assert.Equal(t, nil, tx.Error)
+	assert.Equal(t, 1, len(results))
+	assert.Equal(t, "expression_x", results[0].Product)
+	assert.Equal(t, int64(2), results[0].Count)
+}
+
+func TestSelectRange(t *testing.T) {
+	db.Create(&Event{ID: 1, Name: "range", CreatedAt: time.Date(2026, 1, 20, 0, 0, 0, 0, time.UTC)})
+	db.Create(&Event{ID: 2, Name: "range", CreatedAt: time.Date(2026, 2, 5, 0, 0, 0, 0, time.UTC)})
+	db.Create(&Event{ID: 3, Name: "range", CreatedAt: time.Date(2026, 3, 28, 0, 0, 0, 0, time.UTC)})
+
+	var events []Event
+	tx := db.Where("created_at BETWEEN ? AND ?", time.Date(2026, 1, 15, 0, 0, 0, 0, time.UTC), time.Date(2026, 2, 10, 0, 0, 0, 0, time.UTC)).Order("id").Find(&events)
+	assertQueryResult(t, `SELECT * FROM "events_202601" WHERE "created_at" BETWEEN $1 AND $2 ORDER BY "id"; SELECT * FROM "events_202602" WHERE "created_at" BETWEEN $1 AND $2 ORDER BY "id"`, tx)
+	assert.Equal(t, nil, tx.Error)
+	assert.Equal(t, 2, len(events))
+
+	// Last 7 days
+	events = nil
+	tx = db.Where("created_at >= ?", time.Date(2026, 3, 25, 0, 0, 0, 0, time.UTC)).Find(&events)
+	assertQueryResult(t, `SELECT * FROM "events_202603" WHERE "created_at" >= $1`, tx)
+	assert.Equal(t, nil, tx.Error)
+	assert.Equal(t, 1, len(events))
+}
+
+func TestInsertTimeShardingKey(t *testing.T) {
+	tx := db.Exec(`INSERT INTO events (id, name, created_at) VALUES (10, 'literal', '2026-02-05 10:00:00')`)
+	assertQueryResult(t, `INSERT INTO "events_202602" ("id", "name", "created_at") VALUES (10, 'literal', '2026-02-05 10:00:00')`, tx)
+	assert.Equal(t, nil, tx.Error)
+
+	tx = db.Create(&Event{ID: 11, Name: "bound", CreatedAt: time.Date(2026, 3, 5, 0, 0, 0, 0, time.UTC)})
+	assertQueryResult(t, `INSERT INTO "events_202603" ("name", "created_at", "id") VALUES ($1, $2, $3) RETURNING "id"`, tx)
+	assert.Equal(t, nil, tx.Error)
+
+	tx = db.Create(&Event{ID: 12, Name: "old", CreatedAt: time.Date(2025, 12, 31, 0, 0, 0, 0, time.UTC)})
+	assert.Equal(t, "2025-12-31 00:00:00 +0000 UTC is out of the sharding tables from _202601 to _202603", tx.Error.Error())
+}
+
+func TestSelectTimeShardingKey(t *testing.T) {
+	tx := db.Where("created_at = '2026-01-20T00:00:00Z'").Find(&[]Event{})
+	assertQueryResult(t, `SELECT * FROM "events_202601" WHERE "created_at" = '2026-01-20T00:00:00Z'`, tx)
+	assert.Equal(t, nil, tx.Error)
+
+	tx = db.Where("created_at = ?", time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC)).Find(&[]Event{})
+	assertQueryResult(t, `SELECT * FROM "events_202602" WHERE "created_at" = $1`, tx)
+	assert.Equal(t, nil, tx.Error)
+}
+
+func TestSelectRangeWithoutAlgorithm(t *testing.T) {
+	err := db.Model(&Order{}).Where("user_id > ?", 101).Find(&[]Order{}).Error
+	assert.Equal(t, ErrMissingShardingKey, err)
+}
+
+func TestSelectUnorderedRange(t *testing.T) {
+	r := sharding.Resolvers["orders"]
+	r.ShardingAlgorithmByRange = Modulo(4).Range
+	sharding.Resolvers["orders"] = r
+	defer func() {
+		r.ShardingAlgorithmByRange = nil
+		sharding.Resolvers["orders"] = r
+	}()
+
+	err := db.Model(&Order{}).Where("user_id > ?", 5).Find(&[]Order{}).Error
+	assert.Equal(t, ErrMissingShardingKey, err)
+
+	tx := db.Scopes(ScatterGather).Model(&Order{}).Where("user_id > ?", 5).Find(&[]Order{})
+	assertQueryResult(t, `SELECT * FROM "orders_00" WHERE "user_id" > $1; SELECT * FROM "orders_01" WHERE "user_id" > $1; SELECT * FROM "orders_02" WHERE "user_id" > $1; SELECT * FROM "orders_03" WHERE "user_id" > $1`, tx)
+	assert.Equal(t, nil, tx.Error)
+}
+
+func TestSelectJoinBindingTables(t *testing.T) {
+	db.Create(&Order{ID: 600, UserID: 600, Product: "binding"})
+	db.Create(&OrderItem{ID: 601, OrderID: 600, UserID: 600, Name: "binding"})
+
+	var items []OrderItem
+	tx := db.Table("orders").Select("order_items.*").Joins("JOIN order_items ON order_items.order_id = orders.id").Where("orders.user_id = ?", 600).Find(&items)
+	assertQueryResult(t, `SELECT "order_items_00".* FROM "orders_00" JOIN "order_items_00" ON "order_items_00"."order_id" = "orders_00"."id" WHERE "orders_00"."user_id" = $1`, tx)
+	assert.Equal(t, nil, tx.Error)
+	assert.Equal(t, 1, len(items))
+
+	tx = db.Table("orders AS o").Select("i.*").Joins("JOIN order_items AS i ON i.order_id = o.id").Where("i.user_id IN ?", []int64{600, 601}).Find(&items)
+	assertQueryResult(t, `SELECT "i".* FROM "orders_00" AS "o" JOIN "order_items_00" AS "i" ON "i"."order_id" = "o"."id" WHERE "i"."user_id" IN ($1); SELECT "i".* FROM "orders_01" AS "o" JOIN "order_items_01" AS "i" ON "i"."order_id" = "o"."id" WHERE "i"."user_id" IN ($1)`, tx)
+	assert.Equal(t, nil, tx.Error)
+}
+
+func TestSelectJoinWithoutBinding(t *testing.T) {
+	err := db.Table("orders").Joins("JOIN events ON events.id = orders.id").Where("orders.user_id = ?", 600).Find(&[]Order{}).Error
+	var unsupported *UnsupportedQueryError
+	assert.Equal(t, true, errors.As(err, &unsupported))
+	assert.Equal(t, "orders", unsupported.Table)
+	assert.Equal(t, true, errors.Is(err, ErrUnboundTables))
+	assert.Equal(t, "query on sharding table orders is not supported: sharding tables are not in the same binding group: orders, events", unsupported.Error())
+}
+
+func TestSelectJoinBroadcastTable(t *testing.T) {
+	tx := db.Table("orders").Select("orders.*, categories.name").Joins("JOIN categories ON categories.id = orders.id").Where("orders.user_id = ?", 600).Find(&[]Order{})
+	assertQueryResult(t, `SELECT "orders_00".*, "categories"."name" FROM "orders_00" JOIN "categories" ON "categories"."id" = "orders_00"."id" WHERE "orders_00"."user_id" = $1`, tx)
+	assert.Equal(t, nil, tx.Error)
+}
+
+func TestInsertBroadcastTable(t *testing.T) {
+	tx := db.Create(&Category{ID: 1, Name: "broadcast"})
+	assertQueryResult(t, `INSERT INTO "categories" ("name","id") VALUES ($1,$2) RETURNING "id"`, tx)
+	assert.Equal(t, nil, tx.Error)
+}
+
+func TestSelectExistsSubquery(t *testing.T) {
+	tx := db.Model(&Order{}).Where("user_id = ? AND EXISTS (SELECT 1 FROM order_items WHERE order_items.order_id = orders.id)", 600).Find(&[]Order{})
+	assertQueryResult(t, `SELECT * FROM "orders_00" WHERE "user_id" = $1 AND EXISTS (SELECT 1 FROM "order_items_00" WHERE "order_items_00"."order_id" = "orders_00"."id")`, tx)
+	assert.Equal(t, nil, tx.Error)
+}
+
+func TestSelectFromSubquery(t *testing.T) {
+	tx := db.Table("(SELECT * FROM orders WHERE user_id = ?) AS o", 601).Where("product = ?", "iPhone").Find(&[]Order{})
+	assertQueryResult(t, `SELECT * FROM (SELECT * FROM "orders_01" WHERE "user_id" = $1) AS "o" WHERE "product" = $2`, tx)
+	assert.Equal(t, nil, tx.Error)
+}
+
+func TestSelectSubqueryMissingShardingKey(t *testing.T) {
+	err := db.Model(&Category{}).Where("EXISTS (SELECT 1 FROM orders WHERE product = ?)", "iPhone").Find(&[]Category{}).Error
+	assert.Equal(t, true, errors.Is(err, ErrMissingShardingKey))
+
+	err = db.Model(&Category{}).Where("EXISTS (SELECT 1 FROM orders WHERE user_id IN ?)", []int64{600, 601}).Find(&[]Category{}).Error
+	assert.Equal(t, "subquery on orders matches 2 sharding tables, only one is supported", err.Error())
+}
+
+func TestSelectWithQuery(t *testing.T) {
+	tx := db.Raw("WITH r AS (SELECT * FROM orders WHERE user_id = ?) SELECT * FROM r", 601).Scan(&[]Order{})
+	assertQueryResult(t, `WITH r AS (SELECT * FROM "orders_01" WHERE "user_id" = $1) SELECT * FROM "r"`, tx)
+	assert.Equal(t, nil, tx.Error)
+
+	// The query without the sharding key runs on the sharding table of the statement.
+	tx = db.Raw("WITH items AS (SELECT order_id FROM order_items WHERE name = ?) SELECT * FROM orders WHERE user_id = ? AND id IN (SELECT order_id FROM items) ORDER BY id", "with", 602).Scan(&[]Order{})
+	assertQueryResult(t, `WITH items AS (SELECT "order_id" FROM "order_items_02" WHERE "name" = $1) SELECT * FROM "orders_02" WHERE "user_id" = $2 AND "id" IN (SELECT "order_id" FROM "items") ORDER BY "id"`, tx)
+	assert.Equal(t, nil, tx.Error)
+
+	err := db.Raw("WITH r AS (SELECT * FROM orders WHERE product = ?) SELECT * FROM r", "iPhone").Scan(&[]Order{}).Error
+	assert.Equal(t, true, errors.Is(err, ErrMissingShardingKey))
+
+	err = db.Raw("WITH r AS (SELECT * FROM categories) SELECT * FROM r").Scan(&[]Category{}).Error
+	assert.Equal(t, nil, err)
+}
+
+func TestSelectInSubquery(t *testing.T) {
+	db.Create(&Order{ID: 610, UserID: 601, Product: "in_subquery"})
+	db.Exec("INSERT INTO order_items (id, order_id, user_id, name) VALUES (?, ?, ?, ?)", 610, 610, 601, "in_subquery")
+
+	var orders []Order
+	tx := db.Model(&Order{}).Where("user_id = ? AND id IN (SELECT order_id FROM order_items WHERE name = ?)", 601, "in_subquery").Find(&orders)
+	assertQueryResult(t, `SELECT * FROM "orders_01" WHERE "user_id" = $1 AND "id" IN (SELECT "order_id" FROM "order_items_01" WHERE "name" = $2)`, tx)
+	assert.Equal(t, nil, tx.Error)
+	assert.Equal(t, 1, len(orders))
+	assert.Equal(t, int64(610), orders[0].ID)
+
+	tx = db.Model(&Order{}).Where("user_id = ? AND id NOT IN (SELECT order_id FROM order_items WHERE name = ?)", 601, "in_subquery").Find(&orders)
+	assertQueryResult(t, `SELECT * FROM "orders_01" WHERE "user_id" = $1 AND "id" NOT IN (SELECT "order_id" FROM "order_items_01" WHERE "name" = $2)`, tx)
+	assert.Equal(t, nil, tx.Error)
+
+	// The subquery runs on the sharding table of each query.
+	tx = db.Model(&Order{}).Where("user_id IN ? AND id IN (SELECT order_id FROM order_items WHERE name = ?)", []int64{600, 601}, "in_subquery").Find(&orders)
+	assertQueryResult(t, `SELECT * FROM "orders_00" WHERE "user_id" IN ($1) AND "id" IN (SELECT "order_id" FROM "order_items_00" WHERE "name" = $2); SELECT * FROM "orders_01" WHERE "user_id" IN ($1) AND "id" IN (SELECT "order_id" FROM "order_items_01" WHERE "name" = $2)`, tx)
+	assert.Equal(t, nil, tx.Error)
+	assert.Equal(t, 1, len(orders))
+
+	tx = db.Model(&Category{}).Where("id IN (SELECT order_id FROM order_items WHERE user_id = ?)", 601).Find(&[]Category{})
+	assertQueryResult(t, `SELECT * FROM "categories" WHERE "id" IN (SELECT "order_id" FROM "order_items_01" WHERE "user_id" = $1)`, tx)
+	assert.Equal(t, nil, tx.Error)
+}
+
+func TestSelectNotCondition(t *testing.T) {
+	var unsupported *UnsupportedQueryError
+	err := db.Model(&Order{}).Where("NOT (user_id = ?)", 1).Find(&[]Order{}).Error
+	assert.Equal(t, true, errors.As(err, &unsupported))
+	assert.Equal(t, "orders", unsupported.Table)
+
+	err = db.Raw("SELECT * FROM orders WHERE NOT user_id = ?", 1).Scan(&[]Order{}).Error
+	assert.Equal(t, true, errors.As(err, &unsupported))
+	assert.Equal(t, "orders", unsupported.Table)
+
+	tx := db.Scopes(ScatterGather).Model(&Order{}).Where("user_id <> ?", 1).Find(&[]Order{})
+	assertQueryResult(t, `SELECT * FROM "orders_00" WHERE "user_id" <> $1; SELECT * FROM "orders_01" WHERE "user_id" <> $1; SELECT * FROM "orders_02" WHERE "user_id" <> $1; SELECT * FROM "orders_03" WHERE "user_id" <> $1`, tx)
+	assert.Equal(t, nil, tx.Error)
+}
+
+func TestSelectAlias(t *testing.T) {
+	tx := db.Table("orders o").Select("o.*").Where("o.user_id = ?", 101).Order("o.id").Find(&[]Order{})
+	assertQueryResult(t, `SELECT "o".* FROM "orders_01" AS "o" WHERE "o"."user_id" = $1 ORDER BY "o"."id"`, tx)
+	assert.Equal(t, nil, tx.Error)
+}
+
+func TestSelectQualifiedColumn(t *testing.T) {
+	tx := db.Model(&Order{}).Where(`"orders"."user_id" = ?`, 101).Find(&[]Order{})
+	assertQueryResult(t, `SELECT * FROM "orders_01" WHERE "orders_01"."user_id" = $1`, tx)
+	assert.Equal(t, nil, tx.Error)
+}
+
+func TestInsertFillStringPrimaryKey(t *testing.T) {
+	tx := db.Exec(`INSERT INTO vouchers (user_id, note) VALUES (?, ?)`, 101, "gift")
+	assert.Equal(t, `INSERT INTO "vouchers_01" ("user_id", "note", "code") VALUES ($1, $2, '01-`, sharding.LastQuery()[0:74])
+	assert.Equal(t, nil, tx.Error)
+}
+
+func TestSelectStringPrimaryKey(t *testing.T) {
+	tx := db.Model(&Voucher{}).Where("code = ?", "02-100").Find(&[]Voucher{})
+	assertQueryResult(t, `SELECT * FROM "vouchers_02" WHERE "code" = $1`, tx)
+	assert.Equal(t, nil, tx.Error)
+
+	tx = db.Model(&Voucher{}).Where("code = ?", "x").Find(&[]Voucher{})
+	assert.Equal(t, ErrInvalidID, tx.Error)
+}
+
+func TestSelectDatabase(t *testing.T) {
+	db1Pool.queries = nil
+	tx := db.Model(&Voucher{}).Where("user_id = ?", 103).Find(&[]Voucher{})
+	assertQueryResult(t, `SELECT * FROM "vouchers_03" WHERE "user_id" = $1`, tx)
+	assert.Equal(t, nil, tx.Error)
+	assert.Equal(t, []string{`SELECT * FROM "vouchers_03" WHERE "user_id" = $1`}, db1Pool.queries)
+
+	db1Pool.queries = nil
+	tx = db.Model(&Voucher{}).Where("user_id = ?", 101).Find(&[]Voucher{})
+	assertQueryResult(t, `SELECT * FROM "vouchers_01" WHERE "user_id" = $1`, tx)
+	assert.Equal(t, nil, tx.Error)
+	assert.Equal(t, 0, len(db1Pool.queries))
+}
+
+func TestSelectDatabases(t *testing.T) {
+	db1Pool.queries = nil
+	tx := db.Model(&Voucher{}).Where("user_id IN ?", []int64{101, 102}).Find(&[]Voucher{})
+	assertQueryResult(t, `SELECT * FROM "vouchers_01" WHERE "user_id" IN ($1); SELECT * FROM "vouchers_02" WHERE "user_id" IN ($1)`, tx)
+	assert.Equal(t, nil, tx.Error)
+	assert.Equal(t, []string{`SELECT * FROM "vouchers_02" WHERE "user_id" IN ($1)`}, db1Pool.queries)
+}
+
+func TestInsertBroadcastDatabases(t *testing.T) {
+	db1Pool.queries = nil
+	tx := db.Exec(`INSERT INTO categories (id, name) VALUES (?, ?)`, 910, "databases")
+	assertQueryResult(t, `INSERT INTO categories (id, name) VALUES ($1, $2)`, tx)
+	assert.Equal(t, nil, tx.Error)
+	assert.Equal(t, int64(1), tx.RowsAffected)
+	// The copies run in a transaction on db1, out of db1Pool.
+	assert.Equal(t, 0, len(db1Pool.queries))
+
+	var count int64
+	db1.Table("categories").Where("id = ?", 910).Count(&count)
+	assert.Equal(t, int64(1), count)
+}
+
+func TestSelectReplica(t *testing.T) {
+	replicaPool.queries = nil
+	tx := db.Model(&Order{}).Where("user_id = ?", 101).Find(&[]Order{})
+	assertQueryResult(t, `SELECT * FROM "orders_01" WHERE "user_id" = $1`, tx)
+	assert.Equal(t, nil, tx.Error)
+	assert.Equal(t, []string{`SELECT * FROM "orders_01" WHERE "user_id" = $1`}, replicaPool.queries)
+}
+
+func TestSelectPrimary(t *testing.T) {
+	replicaPool.queries = nil
+	tx := db.WithContext(UsePrimary(context.Background())).Model(&Order{}).Where("user_id = ?", 101).Find(&[]Order{})
+	assertQueryResult(t, `SELECT * FROM "orders_01" WHERE "user_id" = $1`, tx)
+	assert.Equal(t, nil, tx.Error)
+
+	tx = db.Scopes(Primary).Model(&Order{}).Where("user_id = ?", 101).Find(&[]Order{})
+	assertQueryResult(t, `SELECT * FROM "orders_01" WHERE "user_id" = $1`, tx)
+	assert.Equal(t, nil, tx.Error)
+	assert.Equal(t, 0, len(replicaPool.queries))
+}
+
+func TestSelectForUpdatePrimary(t *testing.T) {
+	replicaPool.queries = nil
+	tx := db.Model(&Order{}).Clauses(clause.Locking{Strength: "UPDATE"}).Where("user_id = ?", 101).Find(&[]Order{})
+	assertQueryResult(t, `SELECT * FROM "orders_01" WHERE "user_id" = $1 FOR UPDATE`, tx)
+	assert.Equal(t, 0, len(replicaPool.queries))
+}
+
+func TestSelectIllegalTokenPrimary(t *testing.T) {
+	replicaPool.queries = nil
+	db.Raw("SELECT * FROM categories WHERE name ~ ? FOR UPDATE", "^broadcast").Scan(&[]Category{})
+	assert.Equal(t, 0, len(replicaPool.queries))
+}
+
+func TestWritePrimary(t *testing.T) {
+	replicaPool.queries = nil
+	tx := db.Create(&Order{ID: 920, UserID: 101, Product: "primary"})
+	assertQueryResult(t, `INSERT INTO "orders_01" ("user_id", "product", "id") VALUES ($1, $2, $3) RETURNING "id"`, tx)
+	assert.Equal(t, nil, tx.Error)
+
+	tx = db.Exec("UPDATE orders SET product = ? WHERE user_id = ?", "primary", 101)
+	assertQueryResult(t, `UPDATE "orders_01" SET "product" = $1 WHERE "user_id" = $2`, tx)
+	assert.Equal(t, nil, tx.Error)
+	assert.Equal(t, 0, len(replicaPool.queries))
+}
+
+func TestTransaction(t *testing.T) {
+	replicaPool.queries = nil
+	err := db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Create(&Order{ID: 930, UserID: 101, Product: "transaction"}).Error
+		assertQueryResult(t, `INSERT INTO "orders_01" ("user_id", "product", "id") VALUES ($1, $2, $3) RETURNING "id"`, tx)
+		assert.Equal(t, nil, err)
+
+		var orders []Order
+		err = tx.Model(&Order{}).Where("user_id = ? AND id = ?", 101, 930).Find(&orders).Error
+		assertQueryResult(t, `SELECT * FROM "orders_01" WHERE "user_id" = $1 AND "id" = $2`, tx)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, 1, len(orders))
+
+		return errors.New("rollback")
+	})
+	assert.Equal(t, "rollback", err.Error())
+	assert.Equal(t, 0, len(replicaPool.queries))
+
+	var count int64
+	db.Model(&Order{}).Where("user_id = ? AND id = ?", 101, 930).Count(&count)
+	assert.Equal(t, int64(0), count)
+}
+
+func TestTransactionDatabases(t *testing.T) {
+	db1Pool.queries = nil
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec(`INSERT INTO vouchers (code, user_id, note) VALUES (?, ?, ?)`, "01-930", 101, "transaction").Error; err != nil {
+			return err
+		}
+		return tx.Exec(`INSERT INTO vouchers (code, user_id, note) VALUES (?, ?, ?)`, "03-930", 103, "transaction").Error
+	})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, len(db1Pool.queries))
+
+	var vouchers []Voucher
+	db.Model(&Voucher{}).Where("user_id IN ? AND note = ?", []int64{101, 103}, "transaction").Find(&vouchers)
+	assert.Equal(t, 2, len(vouchers))
+}
+
+func TestTransactionPinShard(t *testing.T) {
+	err := db.WithContext(PinShard(context.Background())).Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&Category{}).Where("id = ?", 1).Find(&[]Category{}).Error
+		assert.Equal(t, nil, err)
+
+		err = tx.Exec(`INSERT INTO vouchers (code, user_id, note) VALUES (?, ?, ?)`, "01-940", 101, "pinned").Error
+		assert.Equal(t, nil, err)
+
+		err = tx.Model(&Voucher{}).Where("user_id = ?", 101).Find(&[]Voucher{}).Error
+		assert.Equal(t, nil, err)
+
+		err = tx.Model(&Order{}).Where("user_id = ?", 105).Find(&[]Order{}).Error
+		assert.Equal(t, nil, err)
+
+		err = tx.Model(&Order{}).Where("user_id = ?", 102).Find(&[]Order{}).Error
+		assert.Equal(t, &CrossShardError{Table: "orders", Suffix: "_02", PinnedSuffix: "_01"}, err)
+
+		err = tx.Exec(`UPDATE vouchers SET note = ? WHERE user_id = ?`, "pinned", 103).Error
+		assert.Equal(t, &CrossShardError{Table: "vouchers", Suffix: "_03", Database: "db1", PinnedSuffix: "_01"}, err)
+
+		var crossShard *CrossShardError
+		err = tx.Model(&Order{}).Where("user_id IN ?", []int64{101, 102}).Find(&[]Order{}).Error
+		assert.Equal(t, true, errors.As(err, &crossShard))
+		return nil
+	})
+	assert.Equal(t, nil, err)
+}
+
+func TestInsertShardTarget(t *testing.T) {
+	account := Account{Region: "eu", Name: "Alice"}
+	tx := db.Create(&account)
+	assert.Equal(t, `INSERT INTO "accounts_eu" ("region", "name", "id") VALUES`, sharding.LastQuery()[0:57])
+	assert.Equal(t, nil, tx.Error)
+	assert.Equal(t, int64(1), keygen.TableIdx(account.ID))
+}
+
+func TestSelectShardTarget(t *testing.T) {
+	tx := db.Model(&Account{}).Where("region = ?", "us").Find(&[]Account{})
+	assertQueryResult(t, `SELECT * FROM "accounts_us" WHERE "region" = $1`, tx)
+	assert.Equal(t, nil, tx.Error)
+}
+
+func TestInsertCompositeKey(t *testing.T) {
+	tx := db.Create(&Ledger{ID: 100, TenantID: 1, AccountID: 3, Amount: 10})
+	assertQueryResult(t, `INSERT INTO "ledgers_11" ("tenant_id", "account_id", "amount", "id") VALUES ($1, $2, $3, $4) RETURNING "id"`, tx)
+	assert.Equal(t, nil, tx.Error)
+}
+
+func TestSelectCompositeKey(t *testing.T) {
+	tx := db.Model(&Ledger{}).Where("tenant_id = ? AND account_id = ?", 1, 2).Find(&[]Ledger{})
+	assertQueryResult(t, `SELECT * FROM "ledgers_10" WHERE "tenant_id" = $1 AND "account_id" = $2`, tx)
+	assert.Equal(t, nil, tx.Error)
+
+	tx = db.Model(&Ledger{}).Where("tenant_id = ? AND account_id IN ?", 1, []int64{2, 3}).Find(&[]Ledger{})
+	assertQueryResult(t, `SELECT * FROM "ledgers_10" WHERE "tenant_id" = $1 AND "account_id" IN ($2, $3); SELECT * FROM "ledgers_11" WHERE "tenant_id" = $1 AND "account_id" IN ($2, $3)`, tx)
+	assert.Equal(t, nil, tx.Error)
+
+	tx = db.Model(&Ledger{}).Where("(tenant_id = ? AND account_id = ?) OR (tenant_id = ? AND account_id = ?)", 1, 2, 2, 2).Find(&[]Ledger{})
+	assertQueryResult(t, `SELECT * FROM "ledgers_10" WHERE ("tenant_id" = $1 AND "account_id" = $2) OR ("tenant_id" = $3 AND "account_id" = $4); SELECT * FROM "ledgers_00" WHERE ("tenant_id" = $1 AND "account_id" = $2) OR ("tenant_id" = $3 AND "account_id" = $4)`, tx)
+	assert.Equal(t, nil, tx.Error)
+}
+
+func TestShardingColumnTypes(t *testing.T) {
+	r := Resolver{
+		ShardingColumns:     []string{"tenant_id", "region", "note"},
+		ShardingColumnTypes: []interface{}{int64(0), "", nil},
+	}
+	values, err := r.normalize([]interface{}{"1", 2, 3})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []interface{}{int64(1), "2", 3}, values)
+
+	tx := db.Exec(`SELECT * FROM ledgers WHERE tenant_id = 1 AND account_id = ?`, int32(2))
+	assertQueryResult(t, `SELECT * FROM "ledgers_10" WHERE "tenant_id" = 1 AND "account_id" = $1`, tx)
+	assert.Equal(t, nil, tx.Error)
+
+	r.ShardingColumnTypes = r.ShardingColumnTypes[:2]
+	r.ShardRouter = ShardRouterFunc(func(values []interface{}) (ShardTarget, error) { return ShardTarget{}, nil })
+	assert.Equal(t, "ShardingColumnTypes has 2 types for 3 ShardingColumns", r.validate().Error())
+}
+
+func TestSelectCompositeKeyMissingColumn(t *testing.T) {
+	tx := db.Model(&Ledger{}).Where("tenant_id = ?", 1).Find(&[]Ledger{})
+	assert.Equal(t, ErrMissingShardingKey, tx.Error)
+
+	tx = db.Model(&Ledger{}).Where("tenant_id = ? OR account_id = ?", 1, 2).Find(&[]Ledger{})
+	assert.Equal(t, ErrMissingShardingKey, tx.Error)
+}
+
+func TestSelectQualifiedColumns(t *testing.T) {
+	tx := db.Model(&Order{}).Select(`"orders"."user_id", COUNT("orders"."id") AS "count"`).Where(`"orders"."user_id" = ?`, 101).
+		Group(`"orders"."user_id"`).Having(`COUNT("orders"."id") > ?`, 0).Find(&[]Order{})
+	assertQueryResult(t, `SELECT "orders_01"."user_id", COUNT("orders_01"."id") AS "count" FROM "orders_01" WHERE "orders_01"."user_id" = $1 GROUP BY "orders_01"."user_id" HAVING COUNT("orders_01"."id") > $2`, tx)
+	assert.Equal(t, nil, tx.Error)
+}
+
+func TestInsertReturningQualifiedColumn(t *testing.T) {
+	tx := db.Exec(`INSERT INTO orders (id, user_id, product) VALUES (?, ?, ?) RETURNING orders.id`, 900, 100, "iPhone")
+	assertQueryResult(t, `INSERT INTO "orders_00" ("id", "user_id", "product") VALUES ($1, $2, $3) RETURNING "orders_00"."id"`, tx)
+	assert.Equal(t, nil, tx.Error)
+}
+
+func TestUpdateReturningQualifiedColumn(t *testing.T) {
+	tx := db.Exec(`UPDATE orders SET product = orders.product WHERE orders.user_id = ? RETURNING orders.id`, 101)
+	assertQueryResult(t, `UPDATE "orders_01" SET "product" = "orders_01"."product" WHERE "orders_01"."user_id" = $1 RETURNING "orders_01"."id"`, tx)
+	assert.Equal(t, nil, tx.Error)
+}
+
+func TestDeleteReturningQualifiedColumn(t *testing.T) {
+	tx := db.Exec(`DELETE FROM orders WHERE orders.user_id = ? RETURNING orders.id`, 102)
+	assertQueryResult(t, `DELETE FROM "orders_02" WHERE "orders_02"."user_id" = $1 RETURNING "orders_02"."id"`, tx)
+	assert.Equal(t, nil, tx.Error)
+}
+
+func TestSelectSchemaQualifiedColumn(t *testing.T) {
+	tx := db.Raw(`SELECT "orders"."id" FROM "public"."orders" WHERE "orders"."user_id" = 101`).Find(&[]Order{})
+	assertQueryResult(t, `SELECT "orders_01"."id" FROM "public"."orders_01" WHERE "orders_01"."user_id" = 101`, tx)
+}
+
+func TestSelectSchemaResolver(t *testing.T) {
+	tx := db.Raw(`SELECT * FROM "audit"."orders" WHERE "user_id" = 103`).Find(&[]Order{})
+	assertQueryResult(t, `SELECT * FROM "audit"."orders_01" WHERE "user_id" = 103`, tx)
+
+	tx = db.Raw(`SELECT * FROM "public"."orders" WHERE "user_id" = 103`).Find(&[]Order{})
+	assertQueryResult(t, `SELECT * FROM "public"."orders_03" WHERE "user_id" = 103`, tx)
+}
+
+func TestSelectNormalizedShardingKey(t *testing.T) {
+	userID := int64(103)
+	for _, value := range []interface{}{103, "103", &userID, sql.NullInt64{Int64: 103, Valid: true}} {
+		tx := db.Raw(`SELECT * FROM "audit"."orders" WHERE "user_id" = ?`, value).Find(&[]Order{})
+		assertQueryResult(t, `SELECT * FROM "audit"."orders_01" WHERE "user_id" = $1`, tx)
+	}
+
+	tx := db.Raw(`SELECT * FROM "audit"."orders" WHERE "user_id" = ?`, "abc").Find(&[]Order{})
+	assert.Equal(t, `invalid integer sharding key "abc"`, tx.Error.Error())
+}
+
+func TestUpdateAlias(t *testing.T) {
+	tx := db.Exec(`UPDATE orders AS o SET product = ? WHERE o.user_id = ?`, "iPad", 101)
+	assertQueryResult(t, `UPDATE "orders_01" AS "o" SET "product" = $1 WHERE "o"."user_id" = $2`, tx)
+	assert.Equal(t, nil, tx.Error)
+}
+
+func TestSelectMirroredComparison(t *testing.T) {
+	tx := db.Model(&Order{}).Where("? = user_id", 101).Find(&[]Order{})
+	assertQueryResult(t, `SELECT * FROM "orders_01" WHERE $1 = "user_id"`, tx)
+	assert.Equal(t, nil, tx.Error)
+}
+
 func TestSelectNoSharding(t *testing.T) {
 	err := db.Exec(`SELECT /* nosharding */ * FROM "orders" WHERE "product" = 'iPad'`).Error
 	assert.Equal(t, nil, err)
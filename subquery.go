@@ -0,0 +1,388 @@
+package sharding
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/longbridgeapp/sqlparser"
+)
+
+// subquery is a nested select on sharding tables, such as an EXISTS condition,
+// a subquery in FROM, or an IN (SELECT ...) condition or a WITH query, see nestSubqueries.
+type subquery struct {
+	renames []*tableRename
+
+	// suffix is the suffix of the sharding tables to run on,
+	// the suffix of the outer statement when it is empty.
+	suffix string
+}
+
+// apply renames the tables of the subquery, outer is the suffix of the outer statement.
+func (sub *subquery) apply(outer string) {
+	suffix := sub.suffix
+	if suffix == "" {
+		suffix = outer
+	}
+	for _, rename := range sub.renames {
+		rename.apply(suffix)
+	}
+}
+
+// routeSubqueries routes each nested select on its own condition to a single sharding table.
+// A nested select without the sharding key runs on the sharding tables of the outer
+// statement when its tables are in the same binding group as the outer tables.
+func (s *Sharding) routeSubqueries(stmt sqlparser.Statement, outer []*sqlparser.TableName, args []interface{}) ([]*subquery, error) {
+	var selects []*sqlparser.SelectStatement
+	walkStatement(stmt, func(node sqlparser.Node) {
+		if sel, ok := node.(*sqlparser.SelectStatement); ok && sel != stmt {
+			selects = append(selects, sel)
+		}
+	})
+
+	var subqueries []*subquery
+	for _, sel := range selects {
+		tables, err := s.bindingTables(sourceTables(sel.FromItems))
+		if err != nil {
+			return nil, err
+		}
+		if len(tables) == 0 {
+			continue
+		}
+		r, _ := s.resolver(tables[0].Name.Name)
+		_, name := splitSchema(tables[0].Name.Name)
+
+		set, _, err := s.route(tables, sel.Condition, args)
+		if err != nil {
+			return nil, err
+		}
+
+		sub := &subquery{renames: newTableRenames(sel, tables)}
+		switch {
+		case set.all && set.unresolved && r.StrictRouting:
+			return nil, ErrUnresolvedCondition
+		case set.all && s.bound(tables[0], outer):
+		case set.all:
+			return nil, fmt.Errorf("%w in the subquery on %s", ErrMissingShardingKey, name)
+		case len(set.suffixes) == 1:
+			sub.suffix = set.suffixes[0]
+		default:
+			return nil, fmt.Errorf("subquery on %s matches %d sharding tables, only one is supported", name, len(set.suffixes))
+		}
+		subqueries = append(subqueries, sub)
+	}
+
+	return subqueries, nil
+}
+
+// subqueryDatabase returns the database of the subqueries, which must be the same one.
+// outer is the suffix of the outer statement.
+func (s *Sharding) subqueryDatabase(subqueries []*subquery, outer string) (database string, err error) {
+	for i, sub := range subqueries {
+		suffix := sub.suffix
+		if suffix == "" {
+			suffix = outer
+		}
+
+		r, _ := s.resolver(sub.renames[0].name)
+		name, err := r.database(suffix)
+		if err != nil {
+			return "", err
+		}
+		if i > 0 && name != database {
+			return "", fmt.Errorf("subqueries in database %q and %q can not run together", database, name)
+		}
+		database = name
+	}
+	return database, nil
+}
+
+// UnsupportedQueryError is returned by a query on a sharding table which can not be
+// parsed, such as a scalar subquery, or which joins sharding tables not in the same
+// binding group, instead of running it on the table named by the query.
+type UnsupportedQueryError struct {
+	// Table is the sharding table in the query.
+	Table string
+	// Err is the error of the parser.
+	Err error
+}
+
+func (e *UnsupportedQueryError) Error() string {
+	return fmt.Sprintf("query on sharding table %s is not supported: %v", e.Table, e.Err)
+}
+
+func (e *UnsupportedQueryError) Unwrap() error {
+	return e.Err
+}
+
+// unparsedTable returns the first sharding table named in a SELECT, INSERT, UPDATE, DELETE
+// or WITH query which can not be parsed. Broadcast tables are not routed, they are skipped.
+func (s *Sharding) unparsedTable(query string) (string, bool) {
+	lexer := sqlparser.NewLexer(strings.NewReader(query))
+	first := true
+	for {
+		_, tok, lit := lexer.Lex()
+		if tok == sqlparser.EOF || tok == sqlparser.ILLEGAL {
+			return "", false
+		}
+		if tok == sqlparser.COMMENT || tok == sqlparser.MLCOMMENT {
+			continue
+		}
+		if first {
+			switch tok {
+			case sqlparser.SELECT, sqlparser.INSERT, sqlparser.UPDATE, sqlparser.DELETE, sqlparser.WITH:
+			default:
+				return "", false
+			}
+			first = false
+			continue
+		}
+
+		if tok != sqlparser.IDENT && tok != sqlparser.QIDENT {
+			continue
+		}
+		if r, ok := s.resolver(lit); ok && !r.Broadcast {
+			if schema, name := splitSchema(lit); schema != "" {
+				return schema + "." + name, true
+			}
+			return lit, true
+		}
+	}
+}
+
+// The hints marking the subqueries rewritten by nestSubqueries.
+const (
+	inSubqueryHint = "sharding:in"
+	withQueryHint  = "sharding:with"
+)
+
+// withClause is the WITH clause of a query, which is not supported by sqlparser.
+// Its queries are routed as EXISTS subqueries of the statement, see attach.
+type withClause struct {
+	headers []string // text before each query, such as "WITH r AS"
+	queries []string
+}
+
+// queryToken is a token of a query at its offset in runes.
+type queryToken struct {
+	offset int
+	tok    sqlparser.Token
+	lit    string
+}
+
+// lexQuery returns the tokens of query without the line comments,
+// ok is false when query has a token sqlparser does not know.
+func lexQuery(query string) (tokens []queryToken, ok bool) {
+	lexer := sqlparser.NewLexer(strings.NewReader(query))
+	for {
+		pos, tok, lit := lexer.Lex()
+		switch tok {
+		case sqlparser.EOF:
+			return tokens, true
+		case sqlparser.ILLEGAL:
+			return nil, false
+		case sqlparser.COMMENT:
+			continue
+		}
+		tokens = append(tokens, queryToken{offset: pos.Offset, tok: tok, lit: lit})
+	}
+}
+
+// closing returns the index of the parenthesis closing the one at index i, or -1.
+func closing(tokens []queryToken, i int) int {
+	depth := 0
+	for ; i < len(tokens); i++ {
+		switch tokens[i].tok {
+		case sqlparser.LP:
+			depth++
+		case sqlparser.RP:
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// nestSubqueries rewrites the subqueries sqlparser can not parse to EXISTS subqueries,
+// which are routed like the others. `IN (SELECT ...)` is rewritten to
+// `IN (EXISTS (SELECT ...))`, and the queries of a WITH clause are split into with,
+// to be added to the statement by attach. unnestSubqueries restores them.
+func nestSubqueries(query string) (string, *withClause) {
+	tokens, ok := lexQuery(query)
+	if !ok {
+		return query, nil
+	}
+
+	runes := []rune(query)
+	inserts := make(map[int]string)
+	for i := 0; i+3 < len(tokens); i++ {
+		if tokens[i].tok != sqlparser.IN || tokens[i+1].tok != sqlparser.LP || tokens[i+2].tok != sqlparser.SELECT || tokens[i+3].tok == sqlparser.MLCOMMENT {
+			continue
+		}
+		if end := closing(tokens, i+1); end > 0 {
+			inserts[tokens[i+2].offset] = "EXISTS ("
+			inserts[tokens[i+3].offset] = "/* " + inSubqueryHint + " */ "
+			inserts[tokens[end].offset] = ")"
+		}
+	}
+	if len(inserts) > 0 {
+		var b strings.Builder
+		for i, r := range runes {
+			b.WriteString(inserts[i])
+			b.WriteRune(r)
+		}
+		query = b.String()
+	}
+
+	return splitWith(query)
+}
+
+// splitWith splits the WITH clause of query, the statement after it is returned.
+func splitWith(query string) (string, *withClause) {
+	tokens, ok := lexQuery(query)
+	if !ok || len(tokens) == 0 || tokens[0].tok != sqlparser.WITH {
+		return query, nil
+	}
+
+	runes := []rune(query)
+	with := &withClause{}
+	for start, i := 0, 1; i < len(tokens); i++ {
+		// The query follows AS or AS [NOT] MATERIALIZED.
+		if tokens[i].tok != sqlparser.LP {
+			continue
+		}
+		if tokens[i-1].tok != sqlparser.AS && !strings.EqualFold(tokens[i-1].lit, "MATERIALIZED") {
+			continue
+		}
+		end := closing(tokens, i)
+		if end < 0 || end+1 == len(tokens) || tokens[i+1].tok != sqlparser.SELECT {
+			return query, nil
+		}
+
+		with.headers = append(with.headers, strings.TrimSpace(string(runes[tokens[start].offset:tokens[i].offset])))
+		with.queries = append(with.queries, string(runes[tokens[i].offset+1:tokens[end].offset]))
+		if tokens[end+1].tok != sqlparser.COMMA {
+			return string(runes[tokens[end+1].offset:]), with
+		}
+		start, i = end+2, end+1
+	}
+	return query, nil
+}
+
+// attach adds the queries of the WITH clause to the condition of stmt as EXISTS subqueries.
+func (w *withClause) attach(stmt sqlparser.Statement) error {
+	var condition *sqlparser.Expr
+	switch stmt := stmt.(type) {
+	case *sqlparser.SelectStatement:
+		condition = &stmt.Condition
+	case *sqlparser.UpdateStatement:
+		condition = &stmt.Condition
+	case *sqlparser.DeleteStatement:
+		condition = &stmt.Condition
+	default:
+		return sqlparser.ErrNotImplemented
+	}
+
+	for _, query := range w.queries {
+		stmt, err := sqlparser.NewParser(strings.NewReader(query)).ParseStatement()
+		if err != nil {
+			return err
+		}
+		sel, ok := stmt.(*sqlparser.SelectStatement)
+		if !ok || sel.Hint != nil {
+			return sqlparser.ErrNotImplemented
+		}
+		sel.Hint = &sqlparser.Hint{Value: withQueryHint}
+
+		exists := &sqlparser.Exists{Select: sel}
+		if *condition == nil {
+			*condition = exists
+		} else {
+			*condition = &sqlparser.BinaryExpr{X: *condition, Op: sqlparser.AND, Y: exists}
+		}
+	}
+	return nil
+}
+
+// unnestSubqueries restores the subqueries rewritten by nestSubqueries in query.
+func unnestSubqueries(query string, with *withClause) string {
+	query = unnestIn(query)
+	if with == nil {
+		return query
+	}
+
+	tokens, ok := lexQuery(query)
+	if !ok {
+		return query
+	}
+
+	// The queries of the WITH clause are the last terms of the condition,
+	// ` WHERE EXISTS (SELECT /* sharding:with */ ...)` or ` AND EXISTS (...)`.
+	runes := []rune(query)
+	var b strings.Builder
+	var queries []string
+	last := 0
+	for i := 1; i+4 < len(tokens); i++ {
+		if !isHinted(tokens, i, withQueryHint) {
+			continue
+		}
+		end := closing(tokens, i+1)
+		if end < 0 {
+			return query
+		}
+		start := tokens[i-1].offset
+		for start > last && runes[start-1] == ' ' {
+			start--
+		}
+		b.WriteString(string(runes[last:start]))
+		queries = append(queries, "SELECT "+string(runes[tokens[i+4].offset:tokens[end].offset]))
+		last = tokens[end].offset + 1
+		i = end
+	}
+	b.WriteString(string(runes[last:]))
+	if len(queries) != len(with.queries) {
+		return query
+	}
+
+	clauses := make([]string, len(queries))
+	for i, q := range queries {
+		clauses[i] = with.headers[i] + " (" + q + ")"
+	}
+	return strings.Join(clauses, ", ") + " " + b.String()
+}
+
+// unnestIn rewrites `EXISTS (SELECT /* sharding:in */ ...)` in query back to `SELECT ...`.
+func unnestIn(query string) string {
+	tokens, ok := lexQuery(query)
+	if !ok {
+		return query
+	}
+
+	runes := []rune(query)
+	var b strings.Builder
+	last := 0
+	for i := 0; i+4 < len(tokens); i++ {
+		if !isHinted(tokens, i, inSubqueryHint) {
+			continue
+		}
+		end := closing(tokens, i+1)
+		if end < 0 {
+			return query
+		}
+		b.WriteString(string(runes[last:tokens[i].offset]))
+		b.WriteString("SELECT ")
+		b.WriteString(unnestIn(string(runes[tokens[i+4].offset:tokens[end].offset])))
+		last = tokens[end].offset + 1
+		i = end
+	}
+	b.WriteString(string(runes[last:]))
+	return b.String()
+}
+
+// isHinted reports whether tokens[i] starts `EXISTS (SELECT /* hint */`,
+// the select list of the subquery starts at tokens[i+4].
+func isHinted(tokens []queryToken, i int, hint string) bool {
+	return tokens[i].tok == sqlparser.EXISTS && tokens[i+1].tok == sqlparser.LP && tokens[i+2].tok == sqlparser.SELECT &&
+		tokens[i+3].tok == sqlparser.MLCOMMENT && tokens[i+3].lit == hint
+}
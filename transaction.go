@@ -0,0 +1,250 @@
+package sharding
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+
+	"gorm.io/gorm"
+)
+
+type pinShardContextKey struct{}
+
+// PinShard returns a context which pins the transaction started with it to one shard.
+// The first statement routed to a sharding table fixes its suffix and database, a later
+// statement routed to another one returns a *CrossShardError.
+//
+//	db.WithContext(sharding.PinShard(ctx)).Transaction(func(tx *gorm.DB) error {
+//		...
+//	})
+func PinShard(ctx context.Context) context.Context {
+	return context.WithValue(ctx, pinShardContextKey{}, true)
+}
+
+// isPinShard reports whether the transaction started with ctx is pinned to one shard.
+func isPinShard(ctx context.Context) bool {
+	enabled, _ := ctx.Value(pinShardContextKey{}).(bool)
+	return enabled
+}
+
+// CrossShardError is returned by a statement in a transaction pinned to a shard, see
+// PinShard, which is routed to another sharding table or database.
+type CrossShardError struct {
+	// Table is the table of the statement.
+	Table string
+	// Suffix and Database are where the statement is routed to.
+	Suffix   string
+	Database string
+	// PinnedSuffix and PinnedDatabase are the shard the transaction is pinned to.
+	PinnedSuffix   string
+	PinnedDatabase string
+}
+
+func (e *CrossShardError) Error() string {
+	return fmt.Sprintf("statement on %s is routed to suffix %q in database %q out of the transaction pinned to suffix %q in database %q",
+		e.Table, e.Suffix, e.Database, e.PinnedSuffix, e.PinnedDatabase)
+}
+
+// BeginTx starts a transaction, the statements in it are routed to the sharding tables
+// as well. The transaction on a database in Sharding.Databases is started by the first
+// statement on it, and the reads in the transaction do not run on the replicas.
+func (pool ConnPool) BeginTx(ctx context.Context, opts *sql.TxOptions) (gorm.ConnPool, error) {
+	conn, err := beginTx(ctx, pool.ConnPool, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	tx := &transaction{
+		ctx:      ctx,
+		opts:     opts,
+		sharding: pool.sharding,
+		pinShard: isPinShard(ctx),
+		base:     pool.ConnPool,
+		conns:    map[string]gorm.ConnPool{"": conn},
+		used:     map[string]bool{},
+	}
+	return &TxConnPool{ConnPool: ConnPool{ConnPool: conn, sharding: pool.sharding, tx: tx}}, nil
+}
+
+// TxConnPool is a transaction of ConnPool.
+type TxConnPool struct {
+	ConnPool
+}
+
+// Commit commits the transactions on all the databases.
+func (pool *TxConnPool) Commit() error {
+	return pool.tx.commit()
+}
+
+// Rollback rolls back the transactions on all the databases.
+func (pool *TxConnPool) Rollback() error {
+	return pool.tx.rollback()
+}
+
+// transaction holds the transactions of a TxConnPool on the databases by name,
+// "" is the database Gorm opened.
+type transaction struct {
+	ctx      context.Context
+	opts     *sql.TxOptions
+	sharding *Sharding
+	pinShard bool
+
+	// base is the connection pool of the database Gorm opened.
+	base gorm.ConnPool
+
+	mu        sync.Mutex
+	conns     map[string]gorm.ConnPool
+	databases []string
+	// used holds the databases with any statement run on.
+	used map[string]bool
+
+	// pinned means the transaction is pinned to the sharding table with pinSuffix
+	// in pinDatabase, by its first statement routed to a sharding table.
+	pinned      bool
+	pinSuffix   string
+	pinDatabase string
+}
+
+// pin checks the queries of a statement on table stay in the shard the transaction is
+// pinned to, and pins it by the first statement routed to a sharding table. The queries
+// not routed to a sharding table only need to stay in the database.
+func (tx *transaction) pin(table string, stQueries []shardQuery) error {
+	if !tx.pinShard {
+		return nil
+	}
+
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	pinned, suffix, database := tx.pinned, tx.pinSuffix, tx.pinDatabase
+	for _, q := range stQueries {
+		if !pinned {
+			if q.suffix == "" {
+				continue
+			}
+			pinned, suffix, database = true, q.suffix, q.database
+		}
+		if q.database != database || q.suffix != "" && q.suffix != suffix {
+			if schema, name := splitSchema(table); schema != "" {
+				table = schema + "." + name
+			}
+			return &CrossShardError{
+				Table:          table,
+				Suffix:         q.suffix,
+				Database:       q.database,
+				PinnedSuffix:   suffix,
+				PinnedDatabase: database,
+			}
+		}
+	}
+	tx.pinned, tx.pinSuffix, tx.pinDatabase = pinned, suffix, database
+	return nil
+}
+
+// conn returns the transaction on database, starts it if not yet.
+func (tx *transaction) conn(database string) (gorm.ConnPool, error) {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if conn, ok := tx.conns[database]; ok {
+		tx.used[database] = true
+		return conn, nil
+	}
+
+	pool, ok := tx.sharding.Databases[database]
+	if !ok {
+		return nil, fmt.Errorf("database %q is not registered", database)
+	}
+	conn, err := beginTx(tx.ctx, pool, tx.opts)
+	if err != nil {
+		return nil, err
+	}
+	tx.conns[database] = conn
+	tx.databases = append(tx.databases, database)
+	tx.used[database] = true
+	return conn, nil
+}
+
+// commit commits the transaction on the database Gorm opened first, then the others
+// in the order they are started. The transactions not committed yet are rolled back
+// when one fails. With Sharding.Coordinator, the transaction which runs statements on
+// several databases is committed by two-phase commit instead.
+func (tx *transaction) commit() error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	databases := append([]string{""}, tx.databases...)
+	if c := tx.sharding.Coordinator; c != nil {
+		var participants []string
+		conns := map[string]gorm.ConnPool{}
+		pools := map[string]gorm.ConnPool{}
+		for _, database := range databases {
+			if tx.used[database] {
+				participants = append(participants, database)
+				conns[database] = tx.conns[database]
+				pools[database] = tx.pool(database)
+			}
+		}
+		if len(participants) > 1 {
+			if !tx.used[""] {
+				tx.conns[""].(gorm.TxCommitter).Rollback()
+			}
+			return c.commit(tx.ctx, participants, conns, pools)
+		}
+	}
+
+	for i, database := range databases {
+		if err := tx.conns[database].(gorm.TxCommitter).Commit(); err != nil {
+			for _, rest := range databases[i+1:] {
+				tx.conns[rest].(gorm.TxCommitter).Rollback()
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// rollback rolls back the transactions on all the databases, and returns the first error.
+func (tx *transaction) rollback() (err error) {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	for _, database := range append([]string{""}, tx.databases...) {
+		if e := tx.conns[database].(gorm.TxCommitter).Rollback(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// pool returns the connection pool of database out of the transaction.
+func (tx *transaction) pool(database string) gorm.ConnPool {
+	if database == "" {
+		return tx.base
+	}
+	return tx.sharding.Databases[database]
+}
+
+// beginTx starts a transaction on pool.
+func beginTx(ctx context.Context, pool gorm.ConnPool, opts *sql.TxOptions) (gorm.ConnPool, error) {
+	switch beginner := pool.(type) {
+	case gorm.TxBeginner:
+		tx, err := beginner.BeginTx(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+		return tx, nil
+	case gorm.ConnPoolBeginner:
+		conn, err := beginner.BeginTx(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := conn.(gorm.TxCommitter); !ok {
+			return nil, gorm.ErrInvalidTransaction
+		}
+		return conn, nil
+	default:
+		return nil, gorm.ErrInvalidTransaction
+	}
+}
@@ -0,0 +1,193 @@
+package sharding
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// convertValue converts the value of a sharding column to the type of sample.
+func convertValue(value, sample interface{}) (interface{}, error) {
+	value, err := indirectValue(value)
+	if err != nil || value == nil {
+		return nil, err
+	}
+
+	switch sample.(type) {
+	case time.Time:
+		return toTime(value)
+	case string:
+		switch v := value.(type) {
+		case string:
+			return v, nil
+		case []byte:
+			return string(v), nil
+		case time.Time:
+			return v.Format(time.RFC3339Nano), nil
+		}
+		return fmt.Sprint(value), nil
+	}
+
+	typ := reflect.TypeOf(sample)
+	switch typ.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := toInt64(value)
+		if err != nil {
+			return nil, err
+		}
+		return reflect.ValueOf(n).Convert(typ).Interface(), nil
+	case reflect.Float32, reflect.Float64:
+		f, err := toFloat64(value)
+		if err != nil {
+			return nil, err
+		}
+		return reflect.ValueOf(f).Convert(typ).Interface(), nil
+	}
+	return nil, fmt.Errorf("unsupported sharding column type %T", sample)
+}
+
+// indirectValue returns the value a pointer or driver.Valuer holds, nil for NULL.
+func indirectValue(value interface{}) (interface{}, error) {
+	for {
+		if value == nil {
+			return nil, nil
+		}
+		if v := reflect.ValueOf(value); v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return nil, nil
+			}
+			if _, ok := value.(driver.Valuer); !ok {
+				value = v.Elem().Interface()
+				continue
+			}
+		}
+		valuer, ok := value.(driver.Valuer)
+		if !ok {
+			return value, nil
+		}
+
+		var err error
+		if value, err = valuer.Value(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// toInt64 converts the value of a sharding key to an integer.
+func toInt64(value interface{}) (int64, error) {
+	switch v := value.(type) {
+	case int:
+		return int64(v), nil
+	case int8:
+		return int64(v), nil
+	case int16:
+		return int64(v), nil
+	case int32:
+		return int64(v), nil
+	case int64:
+		return v, nil
+	case uint:
+		return int64(v), nil
+	case uint8:
+		return int64(v), nil
+	case uint16:
+		return int64(v), nil
+	case uint32:
+		return int64(v), nil
+	case uint64:
+		return int64(v), nil
+	case float32:
+		return toInt64(float64(v))
+	case float64:
+		if v != math.Trunc(v) {
+			return 0, fmt.Errorf("invalid integer sharding key %v", v)
+		}
+		return int64(v), nil
+	case string:
+		n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid integer sharding key %q", v)
+		}
+		return n, nil
+	case []byte:
+		return toInt64(string(v))
+	case driver.Valuer:
+		value, err := v.Value()
+		if err != nil {
+			return 0, err
+		}
+		return toInt64(value)
+	}
+	return 0, fmt.Errorf("invalid integer sharding key %v of type %T", value, value)
+}
+
+// toBytes converts the value of a sharding key to the bytes to hash.
+func toBytes(value interface{}) ([]byte, error) {
+	switch v := value.(type) {
+	case string:
+		return []byte(v), nil
+	case []byte:
+		return v, nil
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return []byte(fmt.Sprint(v)), nil
+	case driver.Valuer:
+		value, err := v.Value()
+		if err != nil {
+			return nil, err
+		}
+		return toBytes(value)
+	case time.Time:
+		// The same instant hashes the same in any location, without the monotonic clock.
+		return []byte(v.UTC().Round(0).Format(time.RFC3339Nano)), nil
+	case fmt.Stringer:
+		return []byte(v.String()), nil
+	}
+	return nil, fmt.Errorf("invalid sharding key %v of type %T", value, value)
+}
+
+// toTime converts the value of a sharding key to a time.
+func toTime(value interface{}) (time.Time, error) {
+	switch v := value.(type) {
+	case time.Time:
+		return v, nil
+	case string:
+		for _, layout := range []string{time.RFC3339Nano, "2006-01-02 15:04:05", "2006-01-02"} {
+			if t, err := time.Parse(layout, v); err == nil {
+				return t, nil
+			}
+		}
+		return time.Time{}, fmt.Errorf("invalid time sharding key %q", v)
+	case driver.Valuer:
+		value, err := v.Value()
+		if err != nil {
+			return time.Time{}, err
+		}
+		return toTime(value)
+	}
+	return time.Time{}, fmt.Errorf("invalid time sharding key %v of type %T", value, value)
+}
+
+// toFloat64 converts the value of a sharding key to a float.
+func toFloat64(value interface{}) (float64, error) {
+	switch v := value.(type) {
+	case float32:
+		return float64(v), nil
+	case float64:
+		return v, nil
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid number sharding key %q", v)
+		}
+		return f, nil
+	case []byte:
+		return toFloat64(string(v))
+	}
+	n, err := toInt64(value)
+	return float64(n), err
+}